@@ -0,0 +1,29 @@
+// litegix-agent is the guest agent the driver injects into every task VM.
+// It serves exec sessions from the host over vsock.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/shadm/nomad-litegix-fc-driver/litegix/agent"
+)
+
+func main() {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:  "litegix-agent",
+		Level: hclog.Info,
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := agent.NewVMAgent(logger).Start(ctx); err != nil {
+		logger.Error("failed to start agent", "error", err)
+		os.Exit(1)
+	}
+	<-ctx.Done()
+}
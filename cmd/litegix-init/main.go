@@ -0,0 +1,9 @@
+// litegix-init is the PID 1 the driver boots every task VM with. The driver
+// injects it into each rootfs and passes it to the kernel as init.
+package main
+
+import "github.com/shadm/nomad-litegix-fc-driver/litegix/vminit"
+
+func main() {
+	vminit.Run()
+}
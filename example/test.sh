@@ -24,7 +24,7 @@ print_info "Building and testing Litegix Firecracker Driver..."
 
 # Step 1: Build driver
 print_info "Building driver..."
-go build -o nomad-litegix-fc-driver
+make guest && go build -o nomad-litegix-fc-driver
 if [ $? -ne 0 ]; then
     print_error "Failed to build driver"
     exit 1
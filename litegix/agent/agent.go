@@ -0,0 +1,447 @@
+// Package agent implements the exec agent that runs inside task VMs and the
+// wire protocol the driver uses to talk to it
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/mdlayher/vsock"
+	"github.com/shadm/nomad-litegix-fc-driver/litegix/vminit"
+	"golang.org/x/sys/unix"
+)
+
+// VsockPort is the vsock port the VM agent listens on
+const VsockPort = 1024
+
+// ExecRequest represents a command execution request
+type ExecRequest struct {
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env,omitempty"`
+	WorkDir string            `json:"workdir,omitempty"`
+	Timeout int               `json:"timeout,omitempty"` // seconds, 0 for none
+
+	// Tty allocates a pseudo-terminal for the command, with Height and
+	// Width as its initial size
+	Tty    bool `json:"tty,omitempty"`
+	Height int  `json:"height,omitempty"`
+	Width  int  `json:"width,omitempty"`
+
+	// Root runs the command as root instead of the workload's user
+	Root bool `json:"root,omitempty"`
+}
+
+// VMAgent handles exec requests inside the VM
+type VMAgent struct {
+	logger   hclog.Logger
+	listener net.Listener
+}
+
+// NewVMAgent creates a new VM agent
+func NewVMAgent(logger hclog.Logger) *VMAgent {
+	return &VMAgent{
+		logger: logger.Named("vm_agent"),
+	}
+}
+
+// Start starts the VM agent listening on vsock
+func (a *VMAgent) Start(ctx context.Context) error {
+	var err error
+
+	// The host reaches the agent through the VM's vsock device
+	a.listener, err = vsock.Listen(VsockPort, nil)
+	if err != nil {
+		a.logger.Error("failed to listen on vsock", "error", err)
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	a.logger.Info("VM agent started", "address", a.listener.Addr())
+
+	go a.handleConnections(ctx)
+	return nil
+}
+
+// handleConnections handles incoming exec requests until ctx is done
+func (a *VMAgent) handleConnections(ctx context.Context) {
+	// Closing the listener unblocks Accept when ctx is done
+	go func() {
+		<-ctx.Done()
+		a.listener.Close()
+	}()
+
+	// Back off on failing Accepts, as net/http does, rather than spin
+	var delay time.Duration
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			a.logger.Error("failed to accept connection", "error", err, "retry_in", delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+
+		go a.handleConnection(conn)
+	}
+}
+
+// handleConnection runs a single exec or file write session
+func (a *VMAgent) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// Read request
+	typ, payload, err := ReadFrame(conn)
+	if err == nil && typ == FrameWriteFile {
+		a.handleWriteFile(conn, payload)
+		return
+	}
+	if err == nil && typ == FrameSignal {
+		a.handleSignal(conn, payload)
+		return
+	}
+	if err != nil || typ != FrameStart {
+		a.logger.Error("failed to read exec request", "error", err, "frame", typ)
+		return
+	}
+	var req ExecRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		a.logger.Error("failed to decode request", "error", err)
+		return
+	}
+
+	a.logger.Info("executing command", "command", req.Command, "tty", req.Tty)
+
+	// Execute command
+	out := NewFrameWriter(conn)
+	exit := a.runSession(conn, out, &req)
+
+	// Send response
+	if err := out.WriteJSON(FrameExit, exit); err != nil {
+		a.logger.Error("failed to send exit status", "error", err)
+	}
+}
+
+// handleWriteFile writes a file sent by the host
+func (a *VMAgent) handleWriteFile(conn net.Conn, payload []byte) {
+	var req WriteFileRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		a.logger.Error("failed to decode request", "error", err)
+		return
+	}
+
+	exit := &ExecExit{}
+	if err := writeFile(conn, &req); err != nil {
+		a.logger.Error("failed to write file", "path", req.Path, "error", err)
+		exit = &ExecExit{ExitCode: 1, Error: err.Error()}
+	}
+	if err := NewFrameWriter(conn).WriteJSON(FrameExit, exit); err != nil {
+		a.logger.Error("failed to send exit status", "error", err)
+	}
+}
+
+// handleSignal sends a signal from the host to the workload
+func (a *VMAgent) handleSignal(conn net.Conn, payload []byte) {
+	var req SignalRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		a.logger.Error("failed to decode request", "error", err)
+		return
+	}
+
+	a.logger.Info("signalling workload", "signal", req.Signal)
+	exit := &ExecExit{}
+	if err := signalWorkload(syscall.Signal(req.Signal)); err != nil {
+		a.logger.Error("failed to signal workload", "signal", req.Signal, "error", err)
+		exit = &ExecExit{ExitCode: 1, Error: err.Error()}
+	}
+	if err := NewFrameWriter(conn).WriteJSON(FrameExit, exit); err != nil {
+		a.logger.Error("failed to send exit status", "error", err)
+	}
+}
+
+// signalWorkload sends sig to the workload whose PID init recorded
+func signalWorkload(sig syscall.Signal) error {
+	data, err := os.ReadFile(vminit.WorkloadPIDPath)
+	if err != nil {
+		return fmt.Errorf("workload is not running: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 1 {
+		return fmt.Errorf("invalid workload PID %q", data)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// writeFile replaces the file at req.Path with the contents read from conn.
+// The file is written next to its destination and renamed into place, so
+// the workload never sees it half written.
+func writeFile(conn net.Conn, req *WriteFileRequest) error {
+	if !filepath.IsAbs(req.Path) {
+		return fmt.Errorf("path %q is not absolute", req.Path)
+	}
+	dir := filepath.Dir(req.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(req.Path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for {
+		typ, data, err := ReadFrame(conn)
+		if err != nil {
+			return fmt.Errorf("failed to read file contents: %w", err)
+		}
+		if typ != FrameStdin {
+			continue
+		}
+		if len(data) == 0 {
+			break
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Chmod(os.FileMode(req.Mode).Perm()); err != nil {
+		return err
+	}
+	if err := f.Chown(req.UID, req.GID); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), req.Path)
+}
+
+// runSession runs the requested command, forwarding stdin and resize frames
+// read from conn to it and its output to out
+func (a *VMAgent) runSession(conn net.Conn, out *FrameWriter, req *ExecRequest) *ExecExit {
+	if len(req.Command) == 0 {
+		return &ExecExit{ExitCode: 1, Error: "no command specified"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	// Sessions run like the workload: as its user, in its environment and
+	// working directory
+	config, err := vminit.ReadConfig()
+	if err != nil {
+		return &ExecExit{ExitCode: 1, Error: err.Error()}
+	}
+
+	// Create command
+	cmd := exec.CommandContext(ctx, req.Command[0], req.Command[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if !req.Root && (config.UID != 0 || config.GID != 0) {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    config.UID,
+			Gid:    config.GID,
+			Groups: []uint32{},
+		}
+	}
+
+	// Set working directory
+	cmd.Dir = config.WorkingDir
+	if req.WorkDir != "" {
+		cmd.Dir = req.WorkDir
+	}
+
+	// Set environment variables
+	cmd.Env = append([]string{}, config.Env...)
+	for key, value := range req.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	var stdin io.WriteCloser
+	var ptmx *os.File
+	var outputs sync.WaitGroup
+
+	if req.Tty {
+		var tty *os.File
+		ptmx, tty, err = openPTY()
+		if err != nil {
+			return &ExecExit{ExitCode: 1, Error: fmt.Sprintf("failed to allocate pty: %v", err)}
+		}
+		defer ptmx.Close()
+		setPTYSize(ptmx, req.Height, req.Width)
+
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		if err := cmd.Start(); err != nil {
+			tty.Close()
+			return &ExecExit{ExitCode: 1, Error: err.Error()}
+		}
+		tty.Close()
+		stdin = ptmx
+
+		outputs.Add(1)
+		go func() {
+			defer outputs.Done()
+			// Reading the master fails with EIO once the session is gone
+			io.Copy(out.StreamWriter(FrameStdout), ptmx)
+		}()
+	} else {
+		stdinPipe, err := cmd.StdinPipe()
+		if err != nil {
+			return &ExecExit{ExitCode: 1, Error: err.Error()}
+		}
+		stdoutPipe, err := cmd.StdoutPipe()
+		if err != nil {
+			return &ExecExit{ExitCode: 1, Error: err.Error()}
+		}
+		stderrPipe, err := cmd.StderrPipe()
+		if err != nil {
+			return &ExecExit{ExitCode: 1, Error: err.Error()}
+		}
+		if err := cmd.Start(); err != nil {
+			return &ExecExit{ExitCode: 1, Error: err.Error()}
+		}
+		stdin = stdinPipe
+
+		outputs.Add(2)
+		go func() {
+			defer outputs.Done()
+			io.Copy(out.StreamWriter(FrameStdout), stdoutPipe)
+		}()
+		go func() {
+			defer outputs.Done()
+			io.Copy(out.StreamWriter(FrameStderr), stderrPipe)
+		}()
+	}
+
+	// Forward input from the client. The command is killed if the client
+	// goes away.
+	go func() {
+		for {
+			typ, payload, err := ReadFrame(conn)
+			if err != nil {
+				cancel()
+				return
+			}
+			switch typ {
+			case FrameStdin:
+				if len(payload) == 0 {
+					if !req.Tty {
+						stdin.Close()
+					}
+					continue
+				}
+				stdin.Write(payload)
+			case FrameResize:
+				var size TerminalSize
+				if ptmx != nil && json.Unmarshal(payload, &size) == nil {
+					setPTYSize(ptmx, size.Height, size.Width)
+				}
+			}
+		}
+	}()
+
+	if req.Tty {
+		// The pty only reports EOF once every process holding the terminal
+		// has exited, so only wait briefly for output after the command
+		// itself is done
+		err := cmd.Wait()
+		done := make(chan struct{})
+		go func() {
+			outputs.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return exitFromError(err)
+	}
+
+	// Pipes must be drained before Wait closes them
+	outputs.Wait()
+	return exitFromError(cmd.Wait())
+}
+
+// exitFromError converts the result of exec.Cmd.Wait into an ExecExit
+func exitFromError(err error) *ExecExit {
+	if err == nil {
+		return &ExecExit{}
+	}
+	exitError, ok := err.(*exec.ExitError)
+	if !ok {
+		return &ExecExit{ExitCode: 1, Error: err.Error()}
+	}
+	exit := &ExecExit{ExitCode: exitError.ExitCode()}
+	if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit.Signal = int(status.Signal())
+		exit.ExitCode = 128 + exit.Signal
+	}
+	return exit
+}
+
+// openPTY allocates a pseudo-terminal, returning its master and slave ends
+func openPTY() (*os.File, *os.File, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := unix.IoctlSetPointerInt(int(ptmx.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(ptmx.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
+
+// setPTYSize sets the terminal size of a pty. Zero sizes are ignored.
+func setPTYSize(ptmx *os.File, height, width int) {
+	if height <= 0 || width <= 0 {
+		return
+	}
+	unix.IoctlSetWinsize(int(ptmx.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row: uint16(height),
+		Col: uint16(width),
+	})
+}
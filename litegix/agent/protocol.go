@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Frame types of the exec protocol spoken between the driver and VMAgent.
+// Every frame is a one byte type, a four byte big endian payload length and
+// the payload. A session starts with a FrameStart from the client and ends
+// with a FrameExit from the agent.
+const (
+	// FrameStart carries the JSON ExecRequest
+	FrameStart byte = iota + 1
+
+	// FrameStdin carries input for the process. An empty payload closes
+	// its stdin.
+	FrameStdin
+
+	// FrameResize carries a JSON TerminalSize for TTY sessions
+	FrameResize
+
+	// FrameStdout and FrameStderr carry the process's output. TTY sessions
+	// only use FrameStdout.
+	FrameStdout
+	FrameStderr
+
+	// FrameExit carries the JSON ExecExit and is the last frame
+	FrameExit
+
+	// FrameWriteFile starts a session that writes a file in the guest
+	// instead of running a command. It carries the JSON WriteFileRequest and
+	// is followed by the file's contents in FrameStdin frames, ended by an
+	// empty one. The agent answers with a FrameExit.
+	FrameWriteFile
+
+	// FrameSignal starts a session that sends a signal to the workload. It
+	// carries the JSON SignalRequest, and the agent answers with a
+	// FrameExit.
+	FrameSignal
+)
+
+// maxFramePayload bounds the payload size accepted from the peer
+const maxFramePayload = 1 << 20
+
+// TerminalSize is the payload of a FrameResize
+type TerminalSize struct {
+	Height int `json:"height"`
+	Width  int `json:"width"`
+}
+
+// WriteFileRequest is the payload of a FrameWriteFile
+type WriteFileRequest struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+}
+
+// SignalRequest is the payload of a FrameSignal
+type SignalRequest struct {
+	Signal int `json:"signal"`
+}
+
+// ExecExit reports how an exec'd process ended
+type ExecExit struct {
+	ExitCode int    `json:"exit_code"`
+	Signal   int    `json:"signal,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// FrameWriter writes frames to a connection. It is safe for concurrent use
+// so output streams can be forwarded from separate goroutines.
+type FrameWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// WriteFrame writes a single frame
+func (f *FrameWriter) WriteFrame(typ byte, payload []byte) error {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := f.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(payload)
+	return err
+}
+
+// WriteJSON writes a frame with v encoded as JSON as its payload
+func (f *FrameWriter) WriteJSON(typ byte, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.WriteFrame(typ, payload)
+}
+
+// StreamWriter returns an io.Writer that sends everything written to it as
+// frames of type typ
+func (f *FrameWriter) StreamWriter(typ byte) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if err := f.WriteFrame(typ, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (w writerFunc) Write(p []byte) (int, error) {
+	return w(p)
+}
+
+// ReadFrame reads a single frame
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFramePayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
@@ -0,0 +1,251 @@
+package litegix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// cgroupCPUPeriod is the period, in microseconds, the CPU time of a
+	// VMM is limited over
+	cgroupCPUPeriod = 100000
+
+	// cgroupMinCPUQuota is the smallest CPU quota the kernel accepts
+	cgroupMinCPUQuota = 1000
+
+	// placeInCgroupHandlerName names the handler moving a VMM into its
+	// cgroup
+	placeInCgroupHandlerName = "litegix.PlaceInCgroup"
+)
+
+// cgroupV1Controllers are the cgroup v1 hierarchies a VMM is placed in
+var cgroupV1Controllers = []string{"cpu", "memory", "cpuset"}
+
+// vmmLimits are the host resources the VMM of a task may use
+type vmmLimits struct {
+	// CPUShares is the task's cpu reservation in MHz and CPUQuota the CPU
+	// time, in microseconds per cgroupCPUPeriod, it translates to
+	CPUShares int64
+	CPUQuota  int64
+
+	// MemoryBytes covers the guest's memory and the VMM overhead
+	MemoryBytes int64
+
+	// Cpuset lists the cores Nomad reserved for the task, if any
+	Cpuset string
+}
+
+// vmmCgroupLimits derives the limits of a VMM from the task's resources.
+// Reserved cores give a quota of one CPU each, and cpu MHz are converted
+// with the ratio VMs are sized with.
+func vmmCgroupLimits(resources *drivers.Resources, size *vmSize, config *Config) *vmmLimits {
+	limits := &vmmLimits{
+		CPUShares:   int64(size.VCPUs * config.CPUMHzPerVCPU),
+		CPUQuota:    int64(size.VCPUs * cgroupCPUPeriod),
+		MemoryBytes: int64(size.MemMiB+config.VMMMemoryOverhead) << 20,
+	}
+	if resources == nil || resources.NomadResources == nil {
+		return limits
+	}
+
+	cpu := resources.NomadResources.Cpu
+	if cpu.CpuShares > 0 {
+		limits.CPUShares = cpu.CpuShares
+	}
+	if len(cpu.ReservedCores) > 0 {
+		cores := make([]string, len(cpu.ReservedCores))
+		for i, core := range cpu.ReservedCores {
+			cores[i] = strconv.Itoa(int(core))
+		}
+		limits.Cpuset = strings.Join(cores, ",")
+		limits.CPUQuota = int64(len(cores) * cgroupCPUPeriod)
+	} else if cpu.CpuShares > 0 {
+		limits.CPUQuota = cpu.CpuShares * cgroupCPUPeriod / int64(config.CPUMHzPerVCPU)
+	}
+	if limits.CPUQuota < cgroupMinCPUQuota {
+		limits.CPUQuota = cgroupMinCPUQuota
+	}
+	return limits
+}
+
+// cgroupV2 reports whether the host uses the unified cgroup hierarchy
+func cgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// cgroupDirs returns the directories of a cgroup path relative to the
+// cgroup root, one per v1 controller on hosts without cgroup v2
+func cgroupDirs(path string) []string {
+	if cgroupV2() {
+		return []string{filepath.Join(cgroupRoot, path)}
+	}
+	dirs := make([]string, len(cgroupV1Controllers))
+	for i, controller := range cgroupV1Controllers {
+		dirs[i] = filepath.Join(cgroupRoot, controller, path)
+	}
+	return dirs
+}
+
+// createVMMCgroup creates the cgroup of a task's VMM under cgroup_parent
+// and applies its limits. It returns the cgroup's path relative to the
+// cgroup root.
+func (vm *firecrackerVMManager) createVMMCgroup(name string, limits *vmmLimits) (string, error) {
+	path := filepath.Join(vm.config.CgroupParent, name)
+	var err error
+	if cgroupV2() {
+		err = createCgroupV2(path, limits)
+	} else {
+		err = createCgroupV1(path, limits)
+	}
+	if err != nil {
+		removeVMMCgroup(path)
+		return "", fmt.Errorf("failed to create VMM cgroup: %w", err)
+	}
+	return path, nil
+}
+
+// createCgroupV2 creates a cgroup with the cpu, memory and cpuset
+// controllers delegated to it by every ancestor
+func createCgroupV2(path string, limits *vmmLimits) error {
+	dir := cgroupRoot
+	for _, elem := range strings.Split(path, string(filepath.Separator)) {
+		// Controllers a kernel lacks are reported when their files are
+		// written below
+		for _, controller := range []string{"+cpu", "+memory", "+cpuset"} {
+			writeCgroupFile(dir, "cgroup.subtree_control", controller)
+		}
+		dir = filepath.Join(dir, elem)
+		if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	// cpu.weight is converted from shares as runc and Nomad do
+	weight := 1 + ((limits.CPUShares-2)*9999)/262142
+	weight = min(max(weight, 1), 10000)
+	files := [][2]string{
+		{"cpu.weight", strconv.FormatInt(weight, 10)},
+		{"cpu.max", fmt.Sprintf("%d %d", limits.CPUQuota, cgroupCPUPeriod)},
+		{"memory.max", strconv.FormatInt(limits.MemoryBytes, 10)},
+	}
+	if limits.Cpuset != "" {
+		files = append(files, [2]string{"cpuset.cpus", limits.Cpuset})
+	}
+	for _, f := range files {
+		if err := writeCgroupFile(dir, f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCgroupV1 creates a cgroup in the cpu, memory and cpuset
+// hierarchies. New cpusets start empty, so every level inherits the cpus
+// and memory nodes of its parent.
+func createCgroupV1(path string, limits *vmmLimits) error {
+	dirs := cgroupDirs(path)
+	for _, dir := range dirs[:2] {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	cpuDir, memoryDir, cpusetDir := dirs[0], dirs[1], dirs[2]
+
+	cpusetRoot := filepath.Join(cgroupRoot, "cpuset")
+	parent := cpusetRoot
+	for _, elem := range strings.Split(path, string(filepath.Separator)) {
+		dir := filepath.Join(parent, elem)
+		if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		for _, name := range []string{"cpuset.cpus", "cpuset.mems"} {
+			value, err := os.ReadFile(filepath.Join(parent, name))
+			if err != nil {
+				return err
+			}
+			if err := writeCgroupFile(dir, name, strings.TrimSpace(string(value))); err != nil {
+				return err
+			}
+		}
+		parent = dir
+	}
+
+	files := [][3]string{
+		{cpuDir, "cpu.shares", strconv.FormatInt(max(limits.CPUShares, 2), 10)},
+		{cpuDir, "cpu.cfs_period_us", strconv.Itoa(cgroupCPUPeriod)},
+		{cpuDir, "cpu.cfs_quota_us", strconv.FormatInt(limits.CPUQuota, 10)},
+		{memoryDir, "memory.limit_in_bytes", strconv.FormatInt(limits.MemoryBytes, 10)},
+	}
+	if limits.Cpuset != "" {
+		files = append(files, [3]string{cpusetDir, "cpuset.cpus", limits.Cpuset})
+	}
+	for _, f := range files {
+		if err := writeCgroupFile(f[0], f[1], f[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeInCgroup moves a process and all its threads into a cgroup
+func placeInCgroup(path string, pid int) error {
+	for _, dir := range cgroupDirs(path) {
+		if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return fmt.Errorf("failed to move VMM into its cgroup: %w", err)
+		}
+	}
+	return nil
+}
+
+// placeInCgroupHandler moves the VMM into its cgroup as soon as it runs,
+// before the guest's memory is allocated and its vCPU threads start
+func placeInCgroupHandler(path string) firecracker.Handler {
+	return firecracker.Handler{
+		Name: placeInCgroupHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			pid, err := m.PID()
+			if err != nil {
+				return err
+			}
+			return placeInCgroup(path, pid)
+		},
+	}
+}
+
+// removeVMMCgroup deletes the cgroup of a VMM. The VMM may take a moment to
+// exit after being stopped, so busy cgroups are retried for a while.
+func removeVMMCgroup(path string) error {
+	if path == "" {
+		return nil
+	}
+	var errs []error
+	for _, dir := range cgroupDirs(path) {
+		var err error
+		for i := 0; i < 20; i++ {
+			err = os.Remove(dir)
+			if err == nil || errors.Is(err, os.ErrNotExist) {
+				err = nil
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
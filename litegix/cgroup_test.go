@@ -0,0 +1,65 @@
+package litegix
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestVMMCgroupLimits(t *testing.T) {
+	config := &Config{CPUMHzPerVCPU: 1000, VMMMemoryOverhead: 16}
+
+	cases := []struct {
+		name      string
+		resources *drivers.Resources
+		size      vmSize
+		want      vmmLimits
+	}{
+		{
+			// Nomad's default cpu = 100 is a tenth of a vCPU's worth of
+			// CPU time
+			name:      "default cpu",
+			resources: testResources(100, nil, 256, 0),
+			size:      vmSize{VCPUs: 1, MemMiB: 240},
+			want:      vmmLimits{CPUShares: 100, CPUQuota: 10000, MemoryBytes: 256 << 20},
+		},
+		{
+			name:      "cpu of several vCPUs",
+			resources: testResources(2500, nil, 1024, 0),
+			size:      vmSize{VCPUs: 3, MemMiB: 1008},
+			want:      vmmLimits{CPUShares: 2500, CPUQuota: 250000, MemoryBytes: 1024 << 20},
+		},
+		{
+			name:      "quota is at least the kernel minimum",
+			resources: testResources(5, nil, 256, 0),
+			size:      vmSize{VCPUs: 1, MemMiB: 240},
+			want:      vmmLimits{CPUShares: 5, CPUQuota: cgroupMinCPUQuota, MemoryBytes: 256 << 20},
+		},
+		{
+			name:      "reserved cores give a CPU each and a cpuset",
+			resources: testResources(4000, []uint16{2, 3}, 512, 0),
+			size:      vmSize{VCPUs: 2, MemMiB: 496},
+			want:      vmmLimits{CPUShares: 4000, CPUQuota: 200000, MemoryBytes: 512 << 20, Cpuset: "2,3"},
+		},
+		{
+			name:      "memory follows the guest, not the reservation",
+			resources: testResources(1000, nil, 256, 1024),
+			size:      vmSize{VCPUs: 1, MemMiB: 512},
+			want:      vmmLimits{CPUShares: 1000, CPUQuota: 100000, MemoryBytes: 528 << 20},
+		},
+		{
+			name: "no resources",
+			size: vmSize{VCPUs: 2, MemMiB: 512},
+			want: vmmLimits{CPUShares: 2000, CPUQuota: 200000, MemoryBytes: 528 << 20},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := vmmCgroupLimits(tc.resources, &tc.size, config)
+			if *got != tc.want {
+				t.Errorf("got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
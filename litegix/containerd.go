@@ -0,0 +1,177 @@
+package litegix
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/hashicorp/go-hclog"
+	"github.com/opencontainers/image-spec/identity"
+)
+
+const (
+	// defaultContainerdNamespace keeps the driver's images and snapshots
+	// apart from those of other containerd clients on the node
+	defaultContainerdNamespace = "litegix"
+
+	// defaultContainerdSnapshotter must hand out block devices, which
+	// firecracker can attach directly as the task's root drive
+	defaultContainerdSnapshotter = "devmapper"
+)
+
+// containerdRootfs pulls images through containerd's content store and
+// gives each task a writable snapshot from a block device snapshotter. Every
+// task holds a lease on its image and snapshot, so containerd's garbage
+// collector reclaims them once the task is released. The image records
+// pulls create would keep images forever, so none is kept.
+type containerdRootfs struct {
+	client      *containerd.Client
+	snapshotter string
+	logger      hclog.Logger
+}
+
+// newContainerdRootfs connects to the containerd daemon listening on socket
+func newContainerdRootfs(socket, namespace, snapshotter string, logger hclog.Logger) (*containerdRootfs, error) {
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+	if snapshotter == "" {
+		snapshotter = defaultContainerdSnapshotter
+	}
+
+	client, err := containerd.New(socket, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd at %s: %w", socket, err)
+	}
+
+	return &containerdRootfs{
+		client:      client,
+		snapshotter: snapshotter,
+		logger:      logger.Named("containerd"),
+	}, nil
+}
+
+// Prepare pulls and unpacks image into the snapshotter and prepares an
+// active snapshot for taskID on top of it
+func (p *containerdRootfs) Prepare(ctx context.Context, image, taskID, vmDir string) (*taskRootfs, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	logger := p.logger.With("image", ref.String(), "task_id", taskID)
+
+	lease, err := p.client.LeasesService().Create(ctx, leases.WithID(containerdLeaseID(taskID)))
+	if err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("failed to create containerd lease: %w", err)
+	}
+	if err != nil {
+		lease = leases.Lease{ID: containerdLeaseID(taskID)}
+	}
+	ctx = leases.WithLease(ctx, lease.ID)
+
+	prepared := false
+	defer func() {
+		if !prepared {
+			p.client.LeasesService().Delete(context.WithoutCancel(ctx), lease)
+		}
+	}()
+
+	// Like Docker, registries on the loopback interface are reached over
+	// plain HTTP
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost)),
+	})
+
+	logger.Info("pulling image through containerd", "snapshotter", p.snapshotter)
+	img, err := p.client.Pull(ctx, ref.String(),
+		containerd.WithResolver(resolver),
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(p.snapshotter),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull image: %w", err)
+	}
+
+	// The content and snapshots stay under the task's lease once the
+	// image record is gone
+	defer func() {
+		err := p.client.ImageService().Delete(context.WithoutCancel(ctx), img.Name())
+		if err != nil && !errdefs.IsNotFound(err) {
+			logger.Warn("failed to delete image record", "error", err)
+		}
+	}()
+
+	spec, err := img.Spec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image rootfs: %w", err)
+	}
+	parent := identity.ChainID(diffIDs).String()
+
+	snapshots := p.client.SnapshotService(p.snapshotter)
+	key := containerdSnapshotKey(taskID)
+
+	// A snapshot left behind by an earlier failed start would make Prepare
+	// fail, and its contents must not leak into the new task
+	if err := snapshots.Remove(ctx, key); err != nil && !errdefs.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to remove stale snapshot: %w", err)
+	}
+
+	mounts, err := snapshots.Prepare(ctx, key, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare snapshot: %w", err)
+	}
+	if len(mounts) != 1 || !isBlockDevice(mounts[0].Source) {
+		snapshots.Remove(ctx, key)
+		return nil, fmt.Errorf("snapshotter %q did not provide a block device; use a block based snapshotter such as devmapper", p.snapshotter)
+	}
+
+	logger.Info("prepared rootfs snapshot", "device", mounts[0].Source, "digest", img.Target().Digest)
+	prepared = true
+	return &taskRootfs{
+		Path:        mounts[0].Source,
+		ImageDigest: img.Target().Digest,
+		ImageConfig: &spec.Config,
+	}, nil
+}
+
+// Release removes the task's snapshot and lease. The image stays in the
+// content store until containerd collects it, which it does once no other
+// task's lease holds it.
+func (p *containerdRootfs) Release(ctx context.Context, taskID string, rootfs *taskRootfs) error {
+	snapshots := p.client.SnapshotService(p.snapshotter)
+	if err := snapshots.Remove(ctx, containerdSnapshotKey(taskID)); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("failed to remove snapshot: %w", err)
+	}
+
+	lease := leases.Lease{ID: containerdLeaseID(taskID)}
+	if err := p.client.LeasesService().Delete(ctx, lease); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("failed to delete containerd lease: %w", err)
+	}
+	return nil
+}
+
+func containerdLeaseID(taskID string) string {
+	return "litegix-" + taskID
+}
+
+func containerdSnapshotKey(taskID string) string {
+	return "litegix-" + taskID
+}
+
+// isBlockDevice reports whether path is a block device node
+func isBlockDevice(path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
@@ -9,15 +9,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/cpustats"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/base"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
-	"github.com/hashicorp/nomad/plugins/shared/structs"
+	digest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -38,21 +42,115 @@ var (
 		"vmlinux_path": hclspec.NewAttr("vmlinux_path", "string", true),
 		"rootfs_base_path": hclspec.NewAttr("rootfs_base_path", "string", true),
 		"containerd_socket": hclspec.NewAttr("containerd_socket", "string", false),
+		"containerd_namespace": hclspec.NewDefault(
+			hclspec.NewAttr("containerd_namespace", "string", false),
+			hclspec.NewLiteral(`"litegix"`),
+		),
+		"containerd_snapshotter": hclspec.NewDefault(
+			hclspec.NewAttr("containerd_snapshotter", "string", false),
+			hclspec.NewLiteral(`"devmapper"`),
+		),
+		"image_gc_delay": hclspec.NewDefault(
+			hclspec.NewAttr("image_gc_delay", "string", false),
+			hclspec.NewLiteral(`"3m"`),
+		),
+		"cpu_mhz_per_vcpu": hclspec.NewDefault(
+			hclspec.NewAttr("cpu_mhz_per_vcpu", "number", false),
+			hclspec.NewLiteral(`1000`),
+		),
+		"vmm_memory_overhead": hclspec.NewDefault(
+			hclspec.NewAttr("vmm_memory_overhead", "number", false),
+			hclspec.NewLiteral(`16`),
+		),
+		"cni_network": hclspec.NewAttr("cni_network", "string", false),
+		"cni_path": hclspec.NewDefault(
+			hclspec.NewAttr("cni_path", "string", false),
+			hclspec.NewLiteral(`"/opt/cni/bin"`),
+		),
+		"cni_config_dir": hclspec.NewDefault(
+			hclspec.NewAttr("cni_config_dir", "string", false),
+			hclspec.NewLiteral(`"/opt/cni/config"`),
+		),
+		"volumes_enabled": hclspec.NewDefault(
+			hclspec.NewAttr("volumes_enabled", "bool", false),
+			hclspec.NewLiteral(`false`),
+		),
+		"volume_image_size": hclspec.NewDefault(
+			hclspec.NewAttr("volume_image_size", "number", false),
+			hclspec.NewLiteral(`1024`),
+		),
+		"cgroup_parent": hclspec.NewDefault(
+			hclspec.NewAttr("cgroup_parent", "string", false),
+			hclspec.NewLiteral(`"litegix"`),
+		),
+		"jailer": hclspec.NewBlock("jailer", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled": hclspec.NewDefault(
+				hclspec.NewAttr("enabled", "bool", false),
+				hclspec.NewLiteral(`true`),
+			),
+			"jailer_path": hclspec.NewDefault(
+				hclspec.NewAttr("jailer_path", "string", false),
+				hclspec.NewLiteral(`"jailer"`),
+			),
+			"firecracker_path": hclspec.NewDefault(
+				hclspec.NewAttr("firecracker_path", "string", false),
+				hclspec.NewLiteral(`"firecracker"`),
+			),
+			"uid_min": hclspec.NewDefault(
+				hclspec.NewAttr("uid_min", "number", false),
+				hclspec.NewLiteral(`100000`),
+			),
+			"uid_max": hclspec.NewDefault(
+				hclspec.NewAttr("uid_max", "number", false),
+				hclspec.NewLiteral(`165535`),
+			),
+			"chroot_base_dir": hclspec.NewDefault(
+				hclspec.NewAttr("chroot_base_dir", "string", false),
+				hclspec.NewLiteral(`"/srv/jailer"`),
+			),
+			"cgroup_version": hclspec.NewDefault(
+				hclspec.NewAttr("cgroup_version", "string", false),
+				hclspec.NewLiteral(`"2"`),
+			),
+			"numa_node": hclspec.NewDefault(
+				hclspec.NewAttr("numa_node", "number", false),
+				hclspec.NewLiteral(`0`),
+			),
+			"daemonize": hclspec.NewDefault(
+				hclspec.NewAttr("daemonize", "bool", false),
+				hclspec.NewLiteral(`false`),
+			),
+		})),
 	})
 
 
 	taskConfigSpec = hclspec.NewObject(map[string]*hclspec.Spec{
 		"image" : hclspec.NewAttr("image","string",true),
-		"vpu_count" : hclspec.NewAttr("vpu_count","number",true),
-		"mem_size" : hclspec.NewAttr("mem_size","number",true),
-		"args" : hclspec.NewAttr("args","string",false),
+		"vpu_count" : hclspec.NewAttr("vpu_count","number",false),
+		"mem_size" : hclspec.NewAttr("mem_size","number",false),
+		"args" : hclspec.NewAttr("args","list(string)",false),
 		"command" : hclspec.NewAttr("command","string",false),
-		"env" : hclspec.NewAttr("env","list(string)",false),
+		"env" : hclspec.NewAttr("env","map(string)",false),
+		"work_dir" : hclspec.NewAttr("work_dir","string",false),
+		"ports" : hclspec.NewAttr("ports","list(string)",false),
+		"volumes" : hclspec.NewAttr("volumes","list(string)",false),
 	})
 
 	capabilities = &drivers.Capabilities{
 		SendSignals: true,
 		Exec:        true,
+
+		// Tasks run from their image's filesystem, so Nomad keeps the host
+		// environment out of the task env and uses in-task paths for it
+		FSIsolation: drivers.FSIsolationImage,
+
+		// VMs join the allocation's network namespace when the group has
+		// one, which Nomad creates
+		NetIsolationModes: []drivers.NetIsolationMode{
+			drivers.NetIsolationModeHost,
+			drivers.NetIsolationModeGroup,
+		},
+		MustInitiateNetwork: false,
 	}
 )
 
@@ -61,17 +159,56 @@ type Config struct {
 	VmlinuxPath     string `codec:"vmlinux_path"`
 	RootfsBasePath  string `codec:"rootfs_base_path"`
 	ContainerdSocket string `codec:"containerd_socket"`
+	ImageGCDelay     string `codec:"image_gc_delay"`
+
+	// ContainerdNamespace and ContainerdSnapshotter select where images and
+	// task snapshots live when ContainerdSocket is set
+	ContainerdNamespace   string `codec:"containerd_namespace"`
+	ContainerdSnapshotter string `codec:"containerd_snapshotter"`
+
+	// CPUMHzPerVCPU converts a task's cpu reservation into vCPUs and into
+	// the CPU quota of its VMM, one CPU per CPUMHzPerVCPU MHz, so a task
+	// reserving less runs on a fraction of a CPU. VMMMemoryOverhead is the
+	// MB of its memory kept for firecracker.
+	CPUMHzPerVCPU     int `codec:"cpu_mhz_per_vcpu"`
+	VMMMemoryOverhead int `codec:"vmm_memory_overhead"`
+
+	// CNINetwork names the CNI network list VMs are connected to, found in
+	// CNIConfigDir with its plugins in the colon separated CNIPath. VMs get
+	// no network when it is empty.
+	CNINetwork   string `codec:"cni_network"`
+	CNIPath      string `codec:"cni_path"`
+	CNIConfigDir string `codec:"cni_config_dir"`
+
+	// VolumesEnabled allows the volumes task option to use host paths
+	// outside the task directory, and VolumeImageSize is the MB of the
+	// images created for directory volumes
+	VolumesEnabled  bool `codec:"volumes_enabled"`
+	VolumeImageSize int  `codec:"volume_image_size"`
+
+	// CgroupParent is the cgroup, relative to the cgroup root, the cgroups
+	// confining each VMM are created in
+	CgroupParent string `codec:"cgroup_parent"`
+
+	// Jailer runs every VMM through the firecracker jailer
+	Jailer JailerConfig `codec:"jailer"`
 }
 
 // TaskConfig contains configuration information for a task that runs with
 // this plugin
 type TaskConfig struct {
-	Image    string   `codec:"image"`
-	VpuCount int      `codec:"vpu_count"`
-	MemSize  int      `codec:"mem_size"`
-	Args     string   `codec:"args"`
-	Command  string   `codec:"command"`
-	Env      []string `codec:"env"`
+	Image    string            `codec:"image"`
+	VpuCount int               `codec:"vpu_count"`
+	MemSize  int               `codec:"mem_size"`
+	Args     []string          `codec:"args"`
+	Command  string            `codec:"command"`
+	Env      map[string]string `codec:"env"`
+	WorkDir  string            `codec:"work_dir"`
+	Ports    []string          `codec:"ports"`
+
+	// Volumes are source:destination[:ro] entries. A read-write directory
+	// source must be empty or hold a volume image, see volumeDrives.
+	Volumes []string `codec:"volumes"`
 }
 
 type TaskState struct {
@@ -79,6 +216,24 @@ type TaskState struct {
 	StartedAt      time.Time
 	ContainerName string
 
+	// VM details needed to reattach to the VM in RecoverTask
+	VMID         string
+	VMDir        string
+	SocketPath   string
+	VsockPath    string
+	RootfsPath   string
+	PID          uint32
+	ImageDigest  digest.Digest
+	NetworkMode  string
+	NetNS        string
+	GuestIP      string
+	TapName      string
+	PortMappings []portMapping
+	JailID       string
+	JailDir      string
+	JailUID      int
+	Cgroup       string
+	VolumeLocks  []volumeLock
 }
 
 // LitegixDriverPlugin is an example driver plugin. When provisioned in a job,
@@ -94,6 +249,9 @@ type LitegixDriverPlugin struct {
 	// nomadConfig is the client config from Nomad
 	nomadConfig *base.ClientDriverConfig
 
+	// compute describes the node's CPUs for CPU usage percentages
+	compute cpustats.Compute
+
 	// tasks is the in memory datastore mapping taskIDs to driver handles
 	tasks *taskStore
 
@@ -110,6 +268,9 @@ type LitegixDriverPlugin struct {
 
 	// vmManager manages firecracker VMs
 	vmManager VMManager
+
+	// kernel caches the guest kernel's fingerprint
+	kernel kernelFingerprint
 }
 
 // NewPlugin returns a new example driver plugin
@@ -155,6 +316,29 @@ func (d *LitegixDriverPlugin) SetConfig(cfg *base.Config) error {
 		return fmt.Errorf("rootfs_base_path is required")
 	}
 
+	if config.ImageGCDelay != "" {
+		if _, err := time.ParseDuration(config.ImageGCDelay); err != nil {
+			return fmt.Errorf("invalid image_gc_delay %q: %w", config.ImageGCDelay, err)
+		}
+	}
+
+	if config.CPUMHzPerVCPU <= 0 {
+		return fmt.Errorf("cpu_mhz_per_vcpu must be positive")
+	}
+	if config.VMMMemoryOverhead < 0 {
+		return fmt.Errorf("vmm_memory_overhead must not be negative")
+	}
+	if config.VolumeImageSize <= 0 {
+		return fmt.Errorf("volume_image_size must be positive")
+	}
+	config.CgroupParent = strings.Trim(filepath.Clean("/"+config.CgroupParent), "/")
+	if config.CgroupParent == "" {
+		return fmt.Errorf("cgroup_parent must not be empty")
+	}
+	if err := config.Jailer.validate(); err != nil {
+		return err
+	}
+
 	// Validate that vmlinux exists
 	if _, err := os.Stat(config.VmlinuxPath); err != nil {
 		return fmt.Errorf("vmlinux_path does not exist: %s", config.VmlinuxPath)
@@ -171,10 +355,15 @@ func (d *LitegixDriverPlugin) SetConfig(cfg *base.Config) error {
 	// Save the Nomad agent configuration
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
+		d.compute = cfg.AgentConfig.Compute()
 	}
 
 	// Initialize VM manager with the configuration
-	d.vmManager = NewVMManager(d.config, d.logger)
+	vmManager, err := NewVMManager(d.config, d.logger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize VM manager: %w", err)
+	}
+	d.vmManager = vmManager
 
 	return nil
 }
@@ -218,31 +407,6 @@ func (d *LitegixDriverPlugin) handleFingerprint(ctx context.Context, ch chan<- *
 	}
 }
 
-// buildFingerprint returns the driver's fingerprint data
-func (d *LitegixDriverPlugin) buildFingerprint() *drivers.Fingerprint {
-	fp := &drivers.Fingerprint{
-		Attributes:        map[string]*structs.Attribute{},
-		Health:            drivers.HealthStateHealthy,
-		HealthDescription: drivers.DriverHealthy,
-	}
-
-	// TODO: implement fingerprinting logic to populate health and driver
-	// attributes.
-	//
-	// Fingerprinting is used by the plugin to relay two important information
-	// to Nomad: health state and node attributes.
-	//
-	// If the plugin reports to be unhealthy, or doesn't send any fingerprint
-	// data in the expected interval of time, Nomad will restart it.
-	//
-	// Node attributes can be used to report any relevant information about
-	// the node in which the plugin is running (specific library availability,
-	// installed versions of a software etc.). These attributes can then be
-	// used by an operator to set job constrains.
-
-	return fp
-}
-
 // StartTask returns a task handle and a driver network if necessary.
 func (d *LitegixDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
 	if _, ok := d.tasks.Get(cfg.ID); ok {
@@ -272,7 +436,7 @@ func (d *LitegixDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskH
 
 	// Create and start the VM
 	ctx := context.Background()
-	h.vmInfo, err = d.vmManager.CreateAndStartVM(ctx, &driverConfig, cfg.ID, h.stdout, h.stderr)
+	h.vmInfo, err = d.vmManager.CreateAndStartVM(ctx, cfg, &driverConfig, h.stdout, h.stderr)
 	if err != nil {
 		h.stdout.Close()
 		h.stderr.Close()
@@ -283,6 +447,7 @@ func (d *LitegixDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskH
 	h.stateLock.Lock()
 	h.startedAt = time.Now()
 	h.procState = drivers.TaskStateRunning
+	h.vmState = VMStateRunning
 	h.stateLock.Unlock()
 
 	// Create Nomad's task handle
@@ -294,6 +459,23 @@ func (d *LitegixDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskH
 		TaskConfig:    cfg,
 		ContainerName: fmt.Sprintf("%s-%s", cfg.Name, cfg.AllocID),
 		StartedAt:     h.startedAt,
+		VMID:          h.vmInfo.VMID,
+		VMDir:         h.vmInfo.VMDir,
+		SocketPath:    h.vmInfo.SocketPath,
+		VsockPath:     h.vmInfo.VsockPath,
+		RootfsPath:    h.vmInfo.RootfsPath,
+		PID:           h.vmInfo.PID,
+		ImageDigest:   h.vmInfo.ImageDigest,
+		NetworkMode:   h.vmInfo.NetworkMode,
+		NetNS:         h.vmInfo.NetNS,
+		GuestIP:       h.vmInfo.GuestIP,
+		TapName:       h.vmInfo.TapName,
+		PortMappings:  h.vmInfo.PortMappings,
+		JailID:        h.vmInfo.JailID,
+		JailDir:       h.vmInfo.JailDir,
+		JailUID:       h.vmInfo.JailUID,
+		Cgroup:        h.vmInfo.Cgroup,
+		VolumeLocks:   h.vmInfo.VolumeLocks,
 	}
 
 	if err := handle.SetDriverState(&driverState); err != nil {
@@ -304,21 +486,31 @@ func (d *LitegixDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskH
 		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
 	}
 
+	// Let Nomad advertise services on the guest's own address. On a group
+	// network services use the allocation's address and ports instead.
+	var network *drivers.DriverNetwork
+	if h.vmInfo.NetworkMode == networkModeCNI {
+		network = &drivers.DriverNetwork{
+			IP:            h.vmInfo.GuestIP,
+			AutoAdvertise: true,
+		}
+	}
+
 	d.tasks.Set(cfg.ID, h)
 	go h.run()
-	return handle, nil, nil
+	return handle, network, nil
 }
 
 // openLogFIFOs opens the stdout and stderr pipes that Nomad provides for log shipping.
 func (d *LitegixDriverPlugin) openLogFIFOs(cfg *drivers.TaskConfig) (io.WriteCloser, io.WriteCloser, error) {
-	// Nomad provides these paths via environment variables to the plugin process.
-	stdoutPath, ok := cfg.Env[drivers.NomadTaskStdout]
-	if !ok {
-		return nil, nil, fmt.Errorf("could not find stdout path in task environment")
+	// Nomad provides these paths in the task config.
+	stdoutPath := cfg.StdoutPath
+	if stdoutPath == "" {
+		return nil, nil, fmt.Errorf("could not find stdout path in task config")
 	}
-	stderrPath, ok := cfg.Env[drivers.NomadTaskStderr]
-	if !ok {
-		return nil, nil, fmt.Errorf("could not find stderr path in task environment")
+	stderrPath := cfg.StderrPath
+	if stderrPath == "" {
+		return nil, nil, fmt.Errorf("could not find stderr path in task config")
 	}
 
 	d.logger.Debug("opening task log FIFOs", "stdout", stdoutPath, "stderr", stderrPath)
@@ -381,16 +573,59 @@ func (d *LitegixDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 
 	d.logger.Info("recovering task", "task_id", handle.Config.ID)
 
-	// Note: For firecracker VMs, full recovery is complex since VMs are ephemeral
-	// In a production implementation, you might want to store VM state information
-	// in the TaskState and attempt to reconnect to running VMs
+	vmInfo := &VMInfo{
+		TaskID:       taskState.TaskConfig.ID,
+		VMID:         taskState.VMID,
+		VMDir:        taskState.VMDir,
+		SocketPath:   taskState.SocketPath,
+		VsockPath:    taskState.VsockPath,
+		RootfsPath:   taskState.RootfsPath,
+		PID:          taskState.PID,
+		CreatedAt:    taskState.StartedAt,
+		ImageDigest:  taskState.ImageDigest,
+		NetworkMode:  taskState.NetworkMode,
+		NetNS:        taskState.NetNS,
+		GuestIP:      taskState.GuestIP,
+		TapName:      taskState.TapName,
+		PortMappings: taskState.PortMappings,
+		JailID:       taskState.JailID,
+		JailDir:      taskState.JailDir,
+		JailUID:      taskState.JailUID,
+		Cgroup:       taskState.Cgroup,
+		VolumeLocks:  taskState.VolumeLocks,
+		TaskDirs:     taskDirs(taskState.TaskConfig),
+	}
+	if vmInfo.NetworkMode == "" && vmInfo.NetNS != "" {
+		// Tasks started before group networks were supported used CNI
+		vmInfo.NetworkMode = networkModeCNI
+	}
+
+	// Reattach to the firecracker process, which keeps running while the
+	// plugin restarts
+	ctx := context.Background()
+	if err := d.vmManager.RecoverVM(ctx, vmInfo); err != nil {
+		// Free whatever the task still holds so nothing leaks when Nomad
+		// replaces it. A VM that is still running is left alone.
+		if taskState.VMDir != "" && !vmmAlive(vmInfo) {
+			d.vmManager.DestroyVM(ctx, vmInfo)
+		}
+		return fmt.Errorf("failed to recover VM: %w", err)
+	}
+
+	// The VM may have been paused before the plugin restarted
+	vmState := VMStateRunning
+	if vmPaused(ctx, vmInfo) {
+		vmState = VMStatePaused
+	}
+
 	h := &taskHandle{
 		taskConfig: taskState.TaskConfig,
 		logger:     d.logger.With("task_id", handle.Config.ID),
 		startedAt:  taskState.StartedAt,
-		procState:  drivers.TaskStateUnknown, // Mark as unknown since VM state is unclear
+		procState:  drivers.TaskStateRunning,
+		vmState:    vmState,
+		vmInfo:     vmInfo,
 		vmManager:  d.vmManager,
-		// vmInfo: nil, // VM info cannot be recovered without persistent state
 	}
 
 	d.tasks.Set(taskState.TaskConfig.ID, h)
@@ -458,9 +693,20 @@ func (d *LitegixDriverPlugin) StopTask(taskID string, timeout time.Duration, sig
 
 	d.logger.Info("stopping task", "task_id", taskID, "timeout", timeout, "signal", signal)
 
+	// The workload gets the task's kill_signal. Without one the guest is
+	// shut down, which stops the workload with SIGTERM.
+	var sig syscall.Signal
+	if signal != "" {
+		if s, ok := signals.SignalLookup[signal].(syscall.Signal); ok {
+			sig = s
+		} else {
+			d.logger.Warn("unknown kill signal, shutting down the guest instead", "signal", signal, "task_id", taskID)
+		}
+	}
+
 	// Use the VM manager to stop the VM
 	ctx := context.Background()
-	if err := d.vmManager.StopVM(ctx, handle.vmInfo, timeout); err != nil {
+	if err := d.vmManager.StopVM(ctx, handle.vmInfo, timeout, sig); err != nil {
 		d.logger.Error("failed to stop VM", "task_id", taskID, "error", err)
 		return fmt.Errorf("failed to stop VM: %w", err)
 	}
@@ -512,13 +758,19 @@ func (d *LitegixDriverPlugin) InspectTask(taskID string) (*drivers.TaskStatus, e
 
 // TaskStats returns a channel which the driver should send stats to at the given interval.
 func (d *LitegixDriverPlugin) TaskStats(ctx context.Context, taskID string, interval time.Duration) (<-chan *drivers.TaskResourceUsage, error) {
-	_, ok := d.tasks.Get(taskID)
+	handle, ok := d.tasks.Get(taskID)
 	if !ok {
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	// For now, return basic stats - in a production implementation you might
-	// want to collect actual VM resource usage statistics
+	handle.stateLock.RLock()
+	vmInfo := handle.vmInfo
+	handle.stateLock.RUnlock()
+	if vmInfo == nil {
+		return nil, fmt.Errorf("task %s has no VM", taskID)
+	}
+	collector := newVMStatsCollector(vmInfo, d.compute)
+
 	ch := make(chan *drivers.TaskResourceUsage)
 	go func() {
 		defer close(ch)
@@ -530,14 +782,12 @@ func (d *LitegixDriverPlugin) TaskStats(ctx context.Context, taskID string, inte
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				// Send basic stats - in production you'd collect real VM stats
-				stats := &drivers.TaskResourceUsage{
-					ResourceUsage: &drivers.ResourceUsage{
-						MemoryStats: &drivers.MemoryStats{},
-						CpuStats:    &drivers.CpuStats{},
-					},
-					Timestamp: time.Now().UTC().UnixNano(),
-					Pids:      map[string]*drivers.ResourceUsage{},
+				stats, err := collector.Collect(ctx)
+				if err != nil {
+					// The VM may be gone because the task exited, which
+					// the handle reports on its own
+					d.logger.Debug("failed to collect task stats", "task_id", taskID, "error", err)
+					continue
 				}
 
 				select {
@@ -567,30 +817,52 @@ func (d *LitegixDriverPlugin) SignalTask(taskID string, signal string) error {
 
 	d.logger.Info("sending signal to task", "task_id", taskID, "signal", signal)
 
-	// For firecracker VMs, we can send signals to the VM process
 	if handle.vmInfo == nil || handle.vmInfo.Machine == nil {
 		return fmt.Errorf("VM info not available for task %s", taskID)
 	}
 
-	pid, err := handle.vmInfo.Machine.PID()
-	if err != nil {
-		return fmt.Errorf("failed to get VM PID: %w", err)
+	if !vmmAlive(handle.vmInfo) {
+		return fmt.Errorf("VM process for task %s is not running", taskID)
 	}
 
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return fmt.Errorf("failed to find VM process: %w", err)
+	// SIGSTOP and SIGCONT pause and resume the whole VM through
+	// firecracker rather than stopping the VMM process
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	switch signal {
+	case "SIGSTOP":
+		if err := d.vmManager.PauseVM(ctx, handle.vmInfo); err != nil {
+			return err
+		}
+		handle.setVMState(VMStatePaused)
+		return nil
+	case "SIGCONT":
+		if err := d.vmManager.ResumeVM(ctx, handle.vmInfo); err != nil {
+			return err
+		}
+		handle.setVMState(VMStateRunning)
+		return nil
+	}
+
+	if handle.vmInfo.ExecClient == nil {
+		return fmt.Errorf("VM agent not available for task %s", taskID)
 	}
 
-	// Convert signal string to os.Signal
-	sig := os.Interrupt
-	if s, ok := signals.SignalLookup[signal]; ok {
+	// Templates with change_mode = "signal" are rendered right before the
+	// signal, so the guest must have them first
+	handle.syncTaskDirs()
+
+	// Convert signal string to a signal number
+	sig := syscall.SIGINT
+	if s, ok := signals.SignalLookup[signal].(syscall.Signal); ok {
 		sig = s
 	} else {
 		d.logger.Warn("unknown signal to send to task, using SIGINT instead", "signal", signal, "task_id", taskID)
 	}
 
-	return process.Signal(sig)
+	// Other signals go to the workload inside the guest through the agent;
+	// sent to firecracker they would end the whole VM
+	return handle.vmInfo.ExecClient.Signal(ctx, sig)
 }
 
 // ExecTask returns the result of executing the given command inside a task.
@@ -607,6 +879,10 @@ func (d *LitegixDriverPlugin) ExecTask(taskID string, cmd []string, timeout time
 
 	d.logger.Info("executing command in VM", "task_id", taskID, "command", cmd)
 
+	// Templates with change_mode = "script" run their script right after
+	// rendering
+	handle.syncTaskDirs()
+
 	// Set default timeout if not provided
 	if timeout == 0 {
 		timeout = 30 * time.Second
@@ -625,13 +901,34 @@ func (d *LitegixDriverPlugin) ExecTask(taskID string, cmd []string, timeout time
 	result := &drivers.ExecTaskResult{
 		Stdout: []byte(response.Stdout),
 		Stderr: []byte(response.Stderr),
-	}
-	
-	// Set exit code if available
-	if response.ExitCode != 0 {
-		result.Stderr = append(result.Stderr, []byte(fmt.Sprintf("\nExit code: %d", response.ExitCode))...)
+		ExitResult: &drivers.ExitResult{
+			ExitCode: response.ExitCode,
+		},
 	}
 
 	d.logger.Info("command executed", "task_id", taskID, "exit_code", response.ExitCode)
 	return result, nil
 }
+
+// ExecTaskStreaming runs a command in the task's VM, streaming its input and
+// output. This backs `nomad alloc exec`, including interactive TTY sessions.
+func (d *LitegixDriverPlugin) ExecTaskStreaming(ctx context.Context, taskID string, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	if handle.vmInfo == nil || handle.vmInfo.ExecClient == nil {
+		return nil, fmt.Errorf("VM not available for exec")
+	}
+
+	d.logger.Info("starting exec session in VM", "task_id", taskID, "command", opts.Command, "tty", opts.Tty)
+
+	result, err := handle.vmInfo.ExecClient.ExecStreaming(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute command: %w", err)
+	}
+
+	d.logger.Info("exec session finished", "task_id", taskID, "exit_code", result.ExitCode)
+	return result, nil
+}
@@ -0,0 +1,456 @@
+package litegix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	// minRootfsSizeMB is the smallest rootfs image the driver creates
+	minRootfsSizeMB = 100
+
+	// bytesPerInode matches mke2fs' default inode ratio
+	bytesPerInode = 16384
+)
+
+// guestFile is a file, directory or symlink written into a guest filesystem
+// image
+type guestFile struct {
+	// Path is the absolute path inside the guest
+	Path string
+	Mode os.FileMode
+	Data []byte
+
+	// Symlink is the link target when the entry is a symlink
+	Symlink string
+
+	// Dir is set for directories
+	Dir bool
+}
+
+// buildExt4 creates an ext4 image at imagePath populated from dir. The
+// filesystem is filled directly by mkfs.ext4 -d, so no loop device, mount
+// or root privileges are needed. fixups restores the metadata the layer
+// applier could not set on the host when running unprivileged.
+func buildExt4(ctx context.Context, dir, imagePath string, fixups *metadataFixups) (int64, error) {
+	var size, inodes int64
+	seen := map[uint64]bool{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		ino := info.Sys().(*syscall.Stat_t).Ino
+		if seen[ino] {
+			// Another path of a hard-linked inode, which the layers
+			// described and which takes no space of its own
+			return nil
+		}
+		seen[ino] = true
+		inodes++
+		if fixups != nil && p != dir {
+			// Files the layers did not describe, such as implicitly created
+			// parent directories, belong to root rather than the host user
+			rel, _ := filepath.Rel(dir, p)
+			fixups.defaultOwner(filepath.ToSlash(rel))
+		}
+		// Round every file up to a whole block
+		size += (info.Size() + 4095) &^ 4095
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to calculate directory size: %w", err)
+	}
+
+	// Add 50% buffer and round up to MB
+	sizeWithBuffer := size * 3 / 2
+	sizeMB := (sizeWithBuffer + 1024*1024 - 1) / (1024 * 1024)
+	if sizeMB < minRootfsSizeMB {
+		sizeMB = minRootfsSizeMB
+	}
+
+	// Create a sparse file of the right size
+	f, err := os.OpenFile(imagePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create rootfs file: %w", err)
+	}
+	if err := f.Truncate(sizeMB * 1024 * 1024); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("failed to size rootfs file: %w", err)
+	}
+	f.Close()
+
+	args := []string{"-F", "-q", "-t", "ext4", "-E", "root_owner=0:0", "-d", dir}
+	// Images with many small files need more inodes than the default ratio
+	// provides
+	if wanted := inodes*3/2 + 1024; wanted > sizeMB*1024*1024/bytesPerInode {
+		args = append(args, "-N", fmt.Sprint(wanted))
+	}
+	args = append(args, imagePath)
+
+	cmd := exec.CommandContext(ctx, "mkfs.ext4", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("failed to format rootfs: %w: %s", err, bytes.TrimSpace(output))
+	}
+
+	if fixups != nil {
+		staging, err := os.MkdirTemp("", "rootfs-fixups-")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create staging dir: %w", err)
+		}
+		defer os.RemoveAll(staging)
+
+		script, err := fixups.script(staging)
+		if err != nil {
+			return 0, err
+		}
+		if script != "" {
+			if err := runDebugfs(ctx, imagePath, script); err != nil {
+				return 0, fmt.Errorf("failed to restore file metadata: %w", err)
+			}
+		}
+	}
+	return sizeMB, nil
+}
+
+// writeExt4Files adds files to an existing ext4 image or block device,
+// replacing entries that already exist. Missing parent directories are
+// created. Files end up owned by root.
+func writeExt4Files(ctx context.Context, imagePath string, files []guestFile) error {
+	staging, err := os.MkdirTemp("", "guest-files-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	var script strings.Builder
+	madeDirs := map[string]bool{"/": true}
+	mkdirAll := func(dir string) {
+		var missing []string
+		for d := dir; !madeDirs[d]; d = path.Dir(d) {
+			missing = append(missing, d)
+			madeDirs[d] = true
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			// Fails harmlessly when the directory already exists
+			fmt.Fprintf(&script, "mkdir %s\n", debugfsQuote(missing[i]))
+		}
+	}
+
+	for i, f := range files {
+		p := path.Clean("/" + f.Path)
+		if hasControlChars(p) || hasControlChars(f.Symlink) {
+			return fmt.Errorf("invalid guest path %q", p)
+		}
+		dir, name := path.Split(p)
+		dir = path.Clean(dir)
+		mkdirAll(dir)
+
+		switch {
+		case f.Dir:
+			mkdirAll(p)
+		case f.Symlink != "":
+			fmt.Fprintf(&script, "rm %s\n", debugfsQuote(p))
+			fmt.Fprintf(&script, "symlink %s %s\n", debugfsQuote(p), debugfsQuote(f.Symlink))
+			continue
+		default:
+			src := filepath.Join(staging, fmt.Sprint(i))
+			if err := os.WriteFile(src, f.Data, 0644); err != nil {
+				return fmt.Errorf("failed to stage %s: %w", p, err)
+			}
+			// debugfs writes into the current directory only
+			fmt.Fprintf(&script, "cd %s\n", debugfsQuote(dir))
+			fmt.Fprintf(&script, "rm %s\n", debugfsQuote(name))
+			fmt.Fprintf(&script, "write %s %s\n", debugfsQuote(src), debugfsQuote(name))
+			fmt.Fprintf(&script, "cd /\n")
+		}
+
+		mode := f.Mode.Perm() | f.Mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+		fmt.Fprintf(&script, "sif %s mode 0%o\n", debugfsQuote(p), inodeMode(mode, f.Dir))
+		fmt.Fprintf(&script, "sif %s uid 0\n", debugfsQuote(p))
+		fmt.Fprintf(&script, "sif %s gid 0\n", debugfsQuote(p))
+	}
+
+	return runDebugfs(ctx, imagePath, script.String())
+}
+
+// readExt4File returns the contents of a file in an ext4 image, or nil if
+// the file does not exist
+func readExt4File(ctx context.Context, imagePath, guestPath string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "debugfs", "-R", "cat "+debugfsQuote(guestPath), imagePath)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w: %s", guestPath, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, nil
+	}
+	return stdout.Bytes(), nil
+}
+
+// runDebugfs runs a debugfs command script against an image in write mode
+func runDebugfs(ctx context.Context, imagePath, script string) error {
+	f, err := os.CreateTemp("", "debugfs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	// debugfs exits 0 even when commands fail, reporting failures on
+	// stderr only
+	cmd := exec.CommandContext(ctx, "debugfs", "-w", "-f", f.Name(), imagePath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debugfs failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var failures []string
+	for i, line := range strings.Split(stderr.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (i == 0 && strings.HasPrefix(line, "debugfs ")) || debugfsHarmless(line) {
+			continue
+		}
+		failures = append(failures, line)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("debugfs failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// debugfsHarmless reports whether a debugfs error comes from a command
+// expected to fail, creating a directory that exists or removing a file
+// that does not before writing it
+func debugfsHarmless(line string) bool {
+	for _, prefix := range []string{
+		"mkdir: Ext2 directory already exists",
+		"ext2fs_mkdir: Ext2 directory already exists",
+		"rm: File not found by ext2_lookup",
+	} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugfsQuote quotes an argument for the debugfs command parser, which
+// takes a doubled quote as a literal one. Scripts hold one command per
+// line, so arguments must not contain control characters.
+func debugfsQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// hasControlChars reports whether s contains characters, such as newlines,
+// that cannot be passed to debugfs
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0
+}
+
+// inodeMode converts a permission mode into the raw i_mode of a regular
+// file or directory
+func inodeMode(mode os.FileMode, dir bool) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	if dir {
+		return m | 0o040000
+	}
+	return m | 0o100000
+}
+
+// metadataFixups collects file metadata the layer applier could not apply
+// on the host, keyed by path relative to the rootfs, so it can be written
+// into the filesystem image afterwards
+type metadataFixups struct {
+	owners  map[string][2]int
+	modes   map[string]uint32
+	devices map[string]deviceNode
+	xattrs  map[string]map[string]string
+}
+
+// deviceNode describes a device node or FIFO in the rootfs
+type deviceNode struct {
+	Type         byte // 'c', 'b' or 'p'
+	Major, Minor int64
+	Mode         os.FileMode
+	UID, GID     int
+}
+
+func newMetadataFixups() *metadataFixups {
+	return &metadataFixups{
+		owners:  map[string][2]int{},
+		modes:   map[string]uint32{},
+		devices: map[string]deviceNode{},
+		xattrs:  map[string]map[string]string{},
+	}
+}
+
+func (m *metadataFixups) setOwner(rel string, uid, gid int) {
+	m.owners[rel] = [2]int{uid, gid}
+}
+
+// setMode records the raw i_mode of rel, which the host copy only
+// approximates
+func (m *metadataFixups) setMode(rel string, mode uint32) {
+	m.modes[rel] = mode
+}
+
+// link records the metadata of source for its hard link rel, so the
+// inode keeps it whichever path is fixed up last, and the link keeps it
+// when source is replaced
+func (m *metadataFixups) link(rel, source string) {
+	if owner, ok := m.owners[source]; ok {
+		m.owners[rel] = owner
+	}
+	if mode, ok := m.modes[source]; ok {
+		m.modes[rel] = mode
+	}
+	if xattrs, ok := m.xattrs[source]; ok {
+		for name, value := range xattrs {
+			m.setXattr(rel, name, value)
+		}
+	}
+}
+
+// defaultOwner makes rel owned by root unless an owner was recorded
+func (m *metadataFixups) defaultOwner(rel string) {
+	if _, ok := m.owners[rel]; !ok {
+		m.owners[rel] = [2]int{0, 0}
+	}
+}
+
+func (m *metadataFixups) addDevice(rel string, dev deviceNode) {
+	m.devices[rel] = dev
+}
+
+func (m *metadataFixups) setXattr(rel, name, value string) {
+	if m.xattrs[rel] == nil {
+		m.xattrs[rel] = map[string]string{}
+	}
+	m.xattrs[rel][name] = value
+}
+
+// remove forgets everything recorded at or below rel
+func (m *metadataFixups) remove(rel string) {
+	under := func(p string) bool {
+		return p == rel || strings.HasPrefix(p, rel+"/")
+	}
+	for p := range m.owners {
+		if under(p) {
+			delete(m.owners, p)
+		}
+	}
+	for p := range m.modes {
+		if under(p) {
+			delete(m.modes, p)
+		}
+	}
+	for p := range m.devices {
+		if under(p) {
+			delete(m.devices, p)
+		}
+	}
+	for p := range m.xattrs {
+		if under(p) {
+			delete(m.xattrs, p)
+		}
+	}
+}
+
+// script renders the fixups as a debugfs command script. xattr values may
+// be binary, so they are staged as files in staging.
+func (m *metadataFixups) script(staging string) (string, error) {
+	var b strings.Builder
+
+	devPaths := make([]string, 0, len(m.devices))
+	for p := range m.devices {
+		devPaths = append(devPaths, p)
+	}
+	sort.Strings(devPaths)
+	for _, p := range devPaths {
+		dev := m.devices[p]
+		guest := "/" + p
+		dir, name := path.Split(guest)
+
+		// debugfs creates nodes in the current directory only
+		fmt.Fprintf(&b, "cd %s\n", debugfsQuote(dir))
+		if dev.Type == 'p' {
+			fmt.Fprintf(&b, "mknod %s p\n", debugfsQuote(name))
+		} else {
+			fmt.Fprintf(&b, "mknod %s %c %d %d\n", debugfsQuote(name), dev.Type, dev.Major, dev.Minor)
+		}
+		fmt.Fprintf(&b, "cd /\n")
+
+		typeBits := map[byte]uint32{'c': 0o020000, 'b': 0o060000, 'p': 0o010000}[dev.Type]
+		fmt.Fprintf(&b, "sif %s mode 0%o\n", debugfsQuote(guest), typeBits|uint32(dev.Mode.Perm()))
+		m.owners[p] = [2]int{dev.UID, dev.GID}
+	}
+
+	paths := make([]string, 0, len(m.owners))
+	for p := range m.owners {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		owner := m.owners[p]
+		guest := debugfsQuote("/" + p)
+		fmt.Fprintf(&b, "sif %s uid %d\nsif %s gid %d\n", guest, owner[0], guest, owner[1])
+	}
+
+	modePaths := make([]string, 0, len(m.modes))
+	for p := range m.modes {
+		modePaths = append(modePaths, p)
+	}
+	sort.Strings(modePaths)
+	for _, p := range modePaths {
+		fmt.Fprintf(&b, "sif %s mode 0%o\n", debugfsQuote("/"+p), m.modes[p])
+	}
+
+	xattrPaths := make([]string, 0, len(m.xattrs))
+	for p := range m.xattrs {
+		xattrPaths = append(xattrPaths, p)
+	}
+	sort.Strings(xattrPaths)
+	for i, p := range xattrPaths {
+		names := make([]string, 0, len(m.xattrs[p]))
+		for name := range m.xattrs[p] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for j, name := range names {
+			valueFile := filepath.Join(staging, fmt.Sprintf("xattr-%d-%d", i, j))
+			if err := os.WriteFile(valueFile, []byte(m.xattrs[p][name]), 0600); err != nil {
+				return "", fmt.Errorf("failed to stage xattr: %w", err)
+			}
+			fmt.Fprintf(&b, "ea_set -f %s %s %s\n", debugfsQuote(valueFile), debugfsQuote("/"+p), debugfsQuote(name))
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,239 @@
+package litegix
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// attrPrefix prefixes the node attributes published by the driver
+	attrPrefix = "driver." + pluginName
+
+	kvmDevice               = "/dev/kvm"
+	defaultDockerSocket     = "/var/run/docker.sock"
+	defaultContainerdSocket = "/run/containerd/containerd.sock"
+
+	// probeTimeout bounds each external check made while fingerprinting
+	probeTimeout = 2 * time.Second
+)
+
+// kernelFingerprint caches the hash of the guest kernel, which only needs
+// to be computed again when the file changes
+type kernelFingerprint struct {
+	lock    sync.Mutex
+	path    string
+	size    int64
+	modTime time.Time
+	sha256  string
+}
+
+// buildFingerprint returns the driver's fingerprint data. Missing KVM or
+// firecracker support leaves the driver undetected, while problems with its
+// configuration make it unhealthy.
+func (d *LitegixDriverPlugin) buildFingerprint() *drivers.Fingerprint {
+	fp := &drivers.Fingerprint{
+		Attributes:        map[string]*structs.Attribute{},
+		Health:            drivers.HealthStateHealthy,
+		HealthDescription: drivers.DriverHealthy,
+	}
+	var problems []string
+	undetected := func(format string, args ...interface{}) {
+		fp.Health = drivers.HealthStateUndetected
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	unhealthy := func(format string, args ...interface{}) {
+		if fp.Health != drivers.HealthStateUndetected {
+			fp.Health = drivers.HealthStateUnhealthy
+		}
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if err := checkKVM(); err != nil {
+		if os.IsNotExist(err) {
+			undetected("%s not found, KVM is not available", kvmDevice)
+		} else {
+			unhealthy("%s is not usable: %v", kvmDevice, err)
+		}
+	} else {
+		fp.Attributes[attrPrefix+".kvm"] = structs.NewBoolAttribute(true)
+	}
+	if virt := cpuVirtualization(); virt != "" {
+		fp.Attributes[attrPrefix+".cpu.virtualization"] = structs.NewStringAttribute(virt)
+	}
+
+	// The jailer copies its configured firecracker into every chroot, so
+	// that is the binary VMs run when it is enabled
+	config := d.config
+	jailed := config != nil && config.Jailer.Enabled
+	firecrackerBin, jailerBin := "firecracker", "jailer"
+	if jailed {
+		firecrackerBin, jailerBin = config.Jailer.FirecrackerPath, config.Jailer.JailerPath
+	}
+
+	if path, version, err := binaryVersion(firecrackerBin); err != nil {
+		undetected("firecracker binary not found: %v", err)
+	} else {
+		fp.Attributes[attrPrefix+".firecracker.path"] = structs.NewStringAttribute(path)
+		fp.Attributes[attrPrefix+".firecracker.version"] = structs.NewStringAttribute(version)
+	}
+	if path, version, err := binaryVersion(jailerBin); err == nil {
+		fp.Attributes[attrPrefix+".jailer"] = structs.NewBoolAttribute(true)
+		fp.Attributes[attrPrefix+".jailer.path"] = structs.NewStringAttribute(path)
+		fp.Attributes[attrPrefix+".jailer.version"] = structs.NewStringAttribute(version)
+	} else {
+		fp.Attributes[attrPrefix+".jailer"] = structs.NewBoolAttribute(false)
+		if jailed {
+			// A VM cannot start without the jailer once it is enabled
+			unhealthy("jailer binary not found: %v", err)
+		}
+	}
+
+	if config == nil || config.VmlinuxPath == "" {
+		unhealthy("driver is not configured")
+	} else {
+		size, sum, err := d.kernel.fingerprint(config.VmlinuxPath)
+		if err != nil {
+			unhealthy("guest kernel is not readable: %v", err)
+		} else {
+			fp.Attributes[attrPrefix+".kernel.path"] = structs.NewStringAttribute(config.VmlinuxPath)
+			fp.Attributes[attrPrefix+".kernel.size"] = structs.NewIntAttribute(size, "B")
+			fp.Attributes[attrPrefix+".kernel.sha256"] = structs.NewStringAttribute(sum)
+		}
+	}
+
+	// Images come from containerd when it is configured, so it must be up
+	containerdSocket := defaultContainerdSocket
+	if config != nil && config.ContainerdSocket != "" {
+		containerdSocket = config.ContainerdSocket
+	}
+	containerdUp := socketReachable(containerdSocket)
+	fp.Attributes[attrPrefix+".containerd.reachable"] = structs.NewBoolAttribute(containerdUp)
+	if !containerdUp && config != nil && config.ContainerdSocket != "" {
+		unhealthy("containerd is not reachable at %s", containerdSocket)
+	}
+	fp.Attributes[attrPrefix+".docker.reachable"] = structs.NewBoolAttribute(socketReachable(defaultDockerSocket))
+
+	if fp.Health == drivers.HealthStateUndetected {
+		// Like Nomad's own drivers, an undetected driver publishes nothing
+		fp.Attributes = map[string]*structs.Attribute{}
+	} else {
+		fp.Attributes["driver."+pluginName] = structs.NewBoolAttribute(true)
+	}
+	if len(problems) > 0 {
+		fp.HealthDescription = strings.Join(problems, "; ")
+		d.logger.Debug("fingerprint found problems", "health", fp.Health, "description", fp.HealthDescription)
+	}
+	return fp
+}
+
+// checkKVM makes sure the KVM device exists and can be opened for VMs
+func checkKVM() error {
+	fi, err := os.Stat(kvmDevice)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("not a character device")
+	}
+	return unix.Access(kvmDevice, unix.R_OK|unix.W_OK)
+}
+
+// cpuVirtualization returns the hardware virtualization extension the host
+// CPU advertises, vmx for Intel VT-x and svm for AMD-V
+func cpuVirtualization() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(key) != "flags" {
+			continue
+		}
+		for _, flag := range strings.Fields(value) {
+			if flag == "vmx" || flag == "svm" {
+				return flag
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// binaryVersion finds name in PATH and returns its location and the
+// version it reports, e.g. "v1.7.0" for "Firecracker v1.7.0"
+func binaryVersion(name string) (string, string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to run %s --version: %w", path, err)
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", "", fmt.Errorf("%s --version printed nothing", path)
+	}
+	return path, fields[len(fields)-1], nil
+}
+
+// fingerprint returns the size and SHA-256 of the kernel at path, hashing
+// it only when it changed since the last call
+func (k *kernelFingerprint) fingerprint(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.path == path && k.size == fi.Size() && k.modTime.Equal(fi.ModTime()) {
+		return k.size, k.sha256, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, "", err
+	}
+	k.path, k.size, k.modTime = path, fi.Size(), fi.ModTime()
+	k.sha256 = hex.EncodeToString(h.Sum(nil))
+	return k.size, k.sha256, nil
+}
+
+// socketReachable reports whether something accepts connections on the
+// unix socket at path
+func socketReachable(path string) bool {
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
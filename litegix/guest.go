@@ -0,0 +1,33 @@
+package litegix
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	// guestDir holds the driver's files inside a task's rootfs
+	guestDir = "/.litegix"
+
+	// guestInitPath is where the guest init is installed in a rootfs
+	guestInitPath = guestDir + "/init"
+
+	// guestAgentPath is where the guest agent is installed in a rootfs
+	guestAgentPath = guestDir + "/litegix-agent"
+)
+
+// guestFiles holds the static guest binaries built by `make guest`
+//
+//go:embed guest
+var guestFiles embed.FS
+
+// guestBinary returns the embedded guest binary called name
+func guestBinary(name string) ([]byte, error) {
+	data, err := guestFiles.ReadFile("guest/" + name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s is not built into the driver, build it with `make guest`", name)
+	}
+	return data, err
+}
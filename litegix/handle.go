@@ -5,6 +5,7 @@ package litegix
 
 import (
 	"context"
+	"io"
 	"strconv"
 	"sync"
 	"time"
@@ -25,8 +26,11 @@ type taskHandle struct {
 	completedAt  time.Time
 	exitResult   *drivers.ExitResult
 	procState    drivers.TaskState
+	vmState      string
 	vmInfo       *VMInfo
 	vmManager    VMManager
+	stdout       io.WriteCloser
+	stderr       io.WriteCloser
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
@@ -48,8 +52,9 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 		CompletedAt: h.completedAt,
 		ExitResult:  h.exitResult,
 		DriverAttributes: map[string]string{
-			"pid":    pid,
-			"vm_id":  vmID,
+			"pid":      pid,
+			"vm_id":    vmID,
+			"vm_state": h.vmState,
 		},
 	}
 }
@@ -88,14 +93,18 @@ func (h *taskHandle) run() {
 				return
 			}
 
+			h.vmState = status.State
 			switch status.State {
-			case VMStateRunning:
+			case VMStateRunning, VMStatePaused:
+				// Nomad has no paused state, a paused VM is still running
 				h.procState = drivers.TaskStateRunning
 			case VMStateStopped:
 				h.procState = drivers.TaskStateExited
 				if status.ExitCode != nil {
 					h.exitResult.ExitCode = int(*status.ExitCode)
 				}
+				h.exitResult.Signal = status.Signal
+				h.exitResult.Err = status.Error
 				if status.ExitedAt != nil {
 					h.completedAt = *status.ExitedAt
 				} else {
@@ -110,6 +119,35 @@ func (h *taskHandle) run() {
 				return
 			}
 			h.stateLock.Unlock()
+
+			// Pass changes to the task directories, such as re-rendered
+			// templates, on to the guest
+			h.syncTaskDirs()
 		}
 	}
 }
+
+// syncTaskDirs copies files that changed in the task directories on the
+// host to the guest. A paused guest cannot take them, so they are copied
+// once it is resumed.
+func (h *taskHandle) syncTaskDirs() {
+	h.stateLock.RLock()
+	paused := h.vmState == VMStatePaused
+	h.stateLock.RUnlock()
+	if paused || h.vmInfo == nil || h.vmInfo.taskDirSync == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), taskDirSyncTimeout)
+	defer cancel()
+	if err := h.vmInfo.taskDirSync.Sync(ctx); err != nil {
+		h.logger.Warn("failed to copy task directory changes to VM", "error", err)
+	}
+}
+
+// setVMState records the state of the task's VM after it was paused or
+// resumed, ahead of the next status check
+func (h *taskHandle) setVMState(state string) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.vmState = state
+}
@@ -0,0 +1,327 @@
+package litegix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// defaultImageGCDelay is how long an unreferenced image stays cached
+	defaultImageGCDelay = 3 * time.Minute
+)
+
+// rootfsBuilder turns a pulled image layout into a pristine rootfs image
+type rootfsBuilder func(ctx context.Context, imageDir, rootfsPath string) error
+
+// cachedImage is a reference to an image held by the cache for a task
+type cachedImage struct {
+	Digest     digest.Digest
+	ImageDir   string
+	RootfsPath string
+}
+
+// imageCache stores pulled images and the pristine rootfs built from each of
+// them under <rootfs_base_path>/cache, keyed by manifest digest. Tasks hold
+// references on entries so images are only removed once no task uses them.
+//
+// Layout:
+//
+//	cache/images/<hex>/      OCI image layout as written by the registry client
+//	cache/rootfs/<hex>.ext4  pristine base rootfs shared by all tasks
+//	cache/refs/<hex>/<task>  one file per task referencing the image
+//	cache/tags/<hex>         digest an image reference last resolved to,
+//	                         named by the reference's SHA-256
+type imageCache struct {
+	dir      string
+	registry *registryClient
+	build    rootfsBuilder
+	gcDelay  time.Duration
+	logger   hclog.Logger
+
+	// lock guards entryLocks and gcTimers
+	lock       sync.Mutex
+	entryLocks map[digest.Digest]*sync.Mutex
+	gcTimers   map[digest.Digest]*time.Timer
+}
+
+// newImageCache returns an imageCache rooted at dir and schedules collection
+// of entries left unreferenced by a previous run of the plugin
+func newImageCache(dir string, registry *registryClient, build rootfsBuilder, gcDelay time.Duration, logger hclog.Logger) *imageCache {
+	c := &imageCache{
+		dir:        dir,
+		registry:   registry,
+		build:      build,
+		gcDelay:    gcDelay,
+		logger:     logger.Named("image_cache"),
+		entryLocks: map[digest.Digest]*sync.Mutex{},
+		gcTimers:   map[digest.Digest]*time.Timer{},
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "rootfs"))
+	for _, e := range entries {
+		hex := trimExt(e.Name())
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, hex)
+		if dgst.Validate() != nil {
+			continue
+		}
+		if c.refCount(dgst) == 0 {
+			c.scheduleGC(dgst)
+		}
+	}
+	return c
+}
+
+// Acquire resolves image, makes sure its pristine rootfs exists in the cache
+// and records a reference for taskID. Images are pulled and built at most
+// once no matter how many tasks use them.
+func (c *imageCache) Acquire(ctx context.Context, image, taskID string) (*cachedImage, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without the registry, fall back to the digest the reference last
+	// resolved to, which is only of use while its rootfs is cached
+	dgst, manifest, manifestData, resolveErr := c.registry.Resolve(ctx, ref)
+	if resolveErr == nil {
+		if err := c.recordTag(ref, dgst); err != nil {
+			c.logger.Warn("failed to record image digest", "image", ref.String(), "error", err)
+		}
+	} else if dgst = c.lookupTag(ref); dgst == "" {
+		return nil, fmt.Errorf("failed to resolve image %s: %w", ref, resolveErr)
+	}
+	logger := c.logger.With("image", ref.String(), "digest", dgst)
+
+	entryLock := c.entryLock(dgst)
+	entryLock.Lock()
+	defer entryLock.Unlock()
+
+	c.cancelGC(dgst)
+
+	entry := c.entry(dgst)
+	if _, err := os.Stat(entry.RootfsPath); err == nil {
+		if resolveErr != nil {
+			logger.Warn("failed to resolve image, using the cached rootfs it last resolved to", "error", resolveErr)
+		} else {
+			logger.Info("using cached rootfs")
+		}
+	} else if resolveErr != nil {
+		return nil, fmt.Errorf("failed to resolve image %s: %w", ref, resolveErr)
+	} else {
+		logger.Info("image not cached, pulling and building rootfs")
+		if _, err := c.registry.Fetch(ctx, ref, dgst, manifest, manifestData, entry.ImageDir); err != nil {
+			return nil, fmt.Errorf("failed to pull image: %w", err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(entry.RootfsPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create rootfs cache directory: %w", err)
+		}
+		tmpPath := entry.RootfsPath + ".tmp"
+		os.Remove(tmpPath)
+		if err := c.build(ctx, entry.ImageDir, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return nil, err
+		}
+		if err := os.Rename(tmpPath, entry.RootfsPath); err != nil {
+			os.Remove(tmpPath)
+			return nil, fmt.Errorf("failed to store rootfs in cache: %w", err)
+		}
+	}
+
+	refDir := c.refDir(dgst)
+	if err := os.MkdirAll(refDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create reference directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(refDir, taskID), nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to record image reference: %w", err)
+	}
+	return entry, nil
+}
+
+// Prepare acquires image for taskID and gives the task its own copy of the
+// cached rootfs in vmDir
+func (c *imageCache) Prepare(ctx context.Context, image, taskID, vmDir string) (*taskRootfs, error) {
+	entry, err := c.Acquire(ctx, image, taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	imageConfig, err := readImageConfig(entry.ImageDir)
+	if err != nil {
+		c.release(entry.Digest, taskID)
+		return nil, err
+	}
+
+	rootfsPath := filepath.Join(vmDir, "rootfs.ext4")
+	if err := c.CloneRootfs(ctx, entry, rootfsPath); err != nil {
+		c.release(entry.Digest, taskID)
+		return nil, err
+	}
+	return &taskRootfs{Path: rootfsPath, ImageDigest: entry.Digest, ImageConfig: imageConfig}, nil
+}
+
+// Release drops the reference the task holds on its image. The task's copy
+// of the rootfs lives in its VM directory and is removed along with it.
+func (c *imageCache) Release(ctx context.Context, taskID string, rootfs *taskRootfs) error {
+	return c.release(rootfs.ImageDigest, taskID)
+}
+
+// release drops the reference taskID holds on the image. Once the last
+// reference is gone the entry is collected after the configured delay.
+func (c *imageCache) release(dgst digest.Digest, taskID string) error {
+	if dgst == "" {
+		return nil
+	}
+	entryLock := c.entryLock(dgst)
+	entryLock.Lock()
+	defer entryLock.Unlock()
+
+	err := os.Remove(filepath.Join(c.refDir(dgst), taskID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to release image reference: %w", err)
+	}
+	if c.refCount(dgst) == 0 {
+		c.scheduleGC(dgst)
+	}
+	return nil
+}
+
+// CloneRootfs makes a per-task copy of a cached rootfs. cp reflinks the file
+// on filesystems that support it and otherwise keeps the copy sparse, so
+// only blocks written by the guest consume extra space. The copy gets the
+// task's environment, so it is only readable by its owner.
+func (c *imageCache) CloneRootfs(ctx context.Context, entry *cachedImage, dst string) error {
+	cmd := exec.CommandContext(ctx, "cp", "--reflink=auto", "--sparse=always", entry.RootfsPath, dst)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy rootfs: %w: %s", err, output)
+	}
+	return os.Chmod(dst, 0600)
+}
+
+// tagPath returns the file recording the digest ref resolved to
+func (c *imageCache) tagPath(ref *imageReference) string {
+	return filepath.Join(c.dir, "tags", digest.FromString(ref.String()).Encoded())
+}
+
+// recordTag remembers that ref resolved to dgst
+func (c *imageCache) recordTag(ref *imageReference, dgst digest.Digest) error {
+	path := c.tagPath(ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(dgst.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lookupTag returns the digest ref last resolved to, or an empty digest if
+// it was never resolved
+func (c *imageCache) lookupTag(ref *imageReference) digest.Digest {
+	data, err := os.ReadFile(c.tagPath(ref))
+	if err != nil {
+		return ""
+	}
+	dgst, err := digest.Parse(string(data))
+	if err != nil {
+		return ""
+	}
+	return dgst
+}
+
+// entry returns the cache paths for dgst
+func (c *imageCache) entry(dgst digest.Digest) *cachedImage {
+	return &cachedImage{
+		Digest:     dgst,
+		ImageDir:   filepath.Join(c.dir, "images", dgst.Encoded()),
+		RootfsPath: filepath.Join(c.dir, "rootfs", dgst.Encoded()+".ext4"),
+	}
+}
+
+func (c *imageCache) refDir(dgst digest.Digest) string {
+	return filepath.Join(c.dir, "refs", dgst.Encoded())
+}
+
+// refCount returns the number of tasks referencing dgst
+func (c *imageCache) refCount(dgst digest.Digest) int {
+	refs, err := os.ReadDir(c.refDir(dgst))
+	if err != nil {
+		return 0
+	}
+	return len(refs)
+}
+
+func (c *imageCache) entryLock(dgst digest.Digest) *sync.Mutex {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	l, ok := c.entryLocks[dgst]
+	if !ok {
+		l = &sync.Mutex{}
+		c.entryLocks[dgst] = l
+	}
+	return l
+}
+
+func (c *imageCache) scheduleGC(dgst digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t, ok := c.gcTimers[dgst]; ok {
+		t.Stop()
+	}
+	c.gcTimers[dgst] = time.AfterFunc(c.gcDelay, func() { c.collect(dgst) })
+}
+
+func (c *imageCache) cancelGC(dgst digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t, ok := c.gcTimers[dgst]; ok {
+		t.Stop()
+		delete(c.gcTimers, dgst)
+	}
+}
+
+// collect removes an entry if it is still unreferenced
+func (c *imageCache) collect(dgst digest.Digest) {
+	entryLock := c.entryLock(dgst)
+	entryLock.Lock()
+	defer entryLock.Unlock()
+
+	c.lock.Lock()
+	delete(c.gcTimers, dgst)
+	c.lock.Unlock()
+
+	if c.refCount(dgst) != 0 {
+		return
+	}
+
+	c.logger.Info("removing unused image from cache", "digest", dgst)
+	entry := c.entry(dgst)
+	for _, path := range []string{entry.RootfsPath, entry.ImageDir, c.refDir(dgst)} {
+		if err := os.RemoveAll(path); err != nil {
+			c.logger.Warn("failed to remove cached image", "path", path, "error", err)
+		}
+	}
+}
+
+// trimExt strips the extension from a file name
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
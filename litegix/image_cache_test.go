@@ -0,0 +1,189 @@
+package litegix
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// testImageCache returns a cache pulling through a test registry client
+// that counts the rootfs images it builds
+func testImageCache(t *testing.T, gcDelay time.Duration) (*imageCache, *int32) {
+	var builds int32
+	build := func(ctx context.Context, imageDir, rootfsPath string) error {
+		atomic.AddInt32(&builds, 1)
+		return os.WriteFile(rootfsPath, []byte("rootfs"), 0644)
+	}
+	c := newImageCache(t.TempDir(), newTestRegistryClient(), build, gcDelay, hclog.NewNullLogger())
+	return c, &builds
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func cached(entry *cachedImage) bool {
+	_, err := os.Stat(entry.RootfsPath)
+	return err == nil
+}
+
+func TestImageCache_AcquireRelease(t *testing.T) {
+	r := newTestRegistry(t)
+	desc, _ := r.addImage([]byte("layer"), "v1")
+	image := r.ref(":v1").String()
+	c, builds := testImageCache(t, 20*time.Millisecond)
+	ctx := context.Background()
+
+	first, err := c.Acquire(ctx, image, "task1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if first.Digest != desc.Digest {
+		t.Errorf("digest = %s, want %s", first.Digest, desc.Digest)
+	}
+	second, err := c.Acquire(ctx, image, "task2")
+	if err != nil {
+		t.Fatalf("second Acquire: %v", err)
+	}
+	if second.RootfsPath != first.RootfsPath {
+		t.Errorf("tasks got different rootfs images")
+	}
+	if atomic.LoadInt32(builds) != 1 {
+		t.Errorf("rootfs built %d times, want once", atomic.LoadInt32(builds))
+	}
+	if n := c.refCount(desc.Digest); n != 2 {
+		t.Errorf("refCount = %d, want 2", n)
+	}
+
+	// The entry stays while a task references it
+	if err := c.release(desc.Digest, "task1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !cached(first) {
+		t.Fatal("entry collected while referenced")
+	}
+
+	if err := c.release(desc.Digest, "task2"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if !waitFor(t, func() bool { return !cached(first) }) {
+		t.Fatal("unreferenced entry was not collected")
+	}
+	if _, err := os.Stat(first.ImageDir); !os.IsNotExist(err) {
+		t.Errorf("image layout left behind: %v", err)
+	}
+
+	// Releasing again, as DestroyTask may after a failed start, is fine
+	if err := c.release(desc.Digest, "task2"); err != nil {
+		t.Errorf("repeated release: %v", err)
+	}
+}
+
+func TestImageCache_ReacquireCancelsGC(t *testing.T) {
+	r := newTestRegistry(t)
+	r.addImage([]byte("layer"), "v1")
+	image := r.ref(":v1").String()
+	c, builds := testImageCache(t, 100*time.Millisecond)
+	ctx := context.Background()
+
+	entry, err := c.Acquire(ctx, image, "task1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := c.release(entry.Digest, "task1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := c.Acquire(ctx, image, "task2"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if !cached(entry) {
+		t.Fatal("entry collected after it was acquired again")
+	}
+	if atomic.LoadInt32(builds) != 1 {
+		t.Errorf("rootfs built %d times, want once", atomic.LoadInt32(builds))
+	}
+}
+
+func TestImageCache_CollectsLeftoversOnStart(t *testing.T) {
+	r := newTestRegistry(t)
+	r.addImage([]byte("layer"), "v1")
+	c, _ := testImageCache(t, time.Hour)
+
+	entry, err := c.Acquire(context.Background(), r.ref(":v1").String(), "task1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := c.release(entry.Digest, "task1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// A restarted plugin collects entries no task references
+	newImageCache(c.dir, c.registry, c.build, 10*time.Millisecond, hclog.NewNullLogger())
+	if !waitFor(t, func() bool { return !cached(entry) }) {
+		t.Fatal("unreferenced entry left by a previous run was not collected")
+	}
+}
+
+func TestImageCache_OfflineFallback(t *testing.T) {
+	r := newTestRegistry(t)
+	desc, _ := r.addImage([]byte("layer"), "v1")
+	r.addImage([]byte("other"), "v2")
+	c, builds := testImageCache(t, 20*time.Millisecond)
+	ctx := context.Background()
+
+	if _, err := c.Acquire(ctx, r.ref(":v1").String(), "task1"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if got := c.lookupTag(r.ref(":v1")); got != desc.Digest {
+		t.Errorf("recorded digest = %q, want %s", got, desc.Digest)
+	}
+
+	r.server.Close()
+
+	// A cached image starts without its registry
+	entry, err := c.Acquire(ctx, r.ref(":v1").String(), "task2")
+	if err != nil {
+		t.Fatalf("Acquire without registry: %v", err)
+	}
+	if entry.Digest != desc.Digest {
+		t.Errorf("digest = %s, want %s", entry.Digest, desc.Digest)
+	}
+	if atomic.LoadInt32(builds) != 1 {
+		t.Errorf("rootfs built %d times, want once", atomic.LoadInt32(builds))
+	}
+
+	// An image never resolved cannot
+	if _, err := c.Acquire(ctx, r.ref(":v2").String(), "task3"); err == nil || !strings.Contains(err.Error(), "failed to resolve") {
+		t.Errorf("Acquire of an unresolved image error = %v, want a resolve error", err)
+	}
+
+	// nor can one whose rootfs was collected
+	c.release(desc.Digest, "task1")
+	c.release(desc.Digest, "task2")
+	if !waitFor(t, func() bool { return !cached(entry) }) {
+		t.Fatal("unreferenced entry was not collected")
+	}
+	if _, err := c.Acquire(ctx, r.ref(":v1").String(), "task4"); err == nil {
+		t.Error("Acquire succeeded without registry or cached rootfs")
+	}
+	if n := c.refCount(desc.Digest); n != 0 {
+		t.Errorf("failed Acquire left %d references", n)
+	}
+}
@@ -0,0 +1,205 @@
+package litegix
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// defaultPath is used when neither the image nor the task sets PATH
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// imageProcess is the workload process of a task, derived from the image
+// config and the task config the same way Docker does
+type imageProcess struct {
+	// Args is the workload's argv
+	Args []string
+
+	// Env holds KEY=VALUE pairs, image values first and the task's
+	// environment applied on top
+	Env []string
+
+	WorkingDir string
+	User       string
+}
+
+// readImageConfig loads the image config blob referenced by the
+// docker-save style manifest.json in an image layout
+func readImageConfig(imageDir string) (*ocispec.ImageConfig, error) {
+	manifestData, err := os.ReadFile(filepath.Join(imageDir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifests []struct {
+		Config string `json:"Config"`
+	}
+	if err := json.Unmarshal(manifestData, &manifests); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if len(manifests) == 0 || manifests[0].Config == "" {
+		return nil, fmt.Errorf("image manifest does not reference a config")
+	}
+
+	configData, err := os.ReadFile(filepath.Join(imageDir, manifests[0].Config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+
+	var image ocispec.Image
+	if err := json.Unmarshal(configData, &image); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	return &image.Config, nil
+}
+
+// mergeImageConfig combines the image config with the task config. command
+// replaces the image Entrypoint and args replaces its Cmd; overriding the
+// Entrypoint drops the image Cmd as well. The result is an exact argv that
+// runs without a shell. user and workDir override the image's User and
+// WorkingDir when set.
+//
+// The environment is layered like the docker driver does it: the image Env,
+// then the task environment computed by Nomad, including NOMAD_* variables
+// and the job's env block, then the driver config's env.
+func mergeImageConfig(image *ocispec.ImageConfig, config *TaskConfig, taskEnv map[string]string, user, workDir string) *imageProcess {
+	if image == nil {
+		image = &ocispec.ImageConfig{}
+	}
+
+	var args []string
+	if config.Command != "" {
+		args = append(args, config.Command)
+	} else {
+		args = append(args, image.Entrypoint...)
+	}
+	if len(config.Args) > 0 {
+		args = append(args, config.Args...)
+	} else if config.Command == "" {
+		args = append(args, image.Cmd...)
+	}
+
+	process := &imageProcess{
+		Args:       args,
+		Env:        mergeEnv(image.Env, envList(taskEnv), envList(config.Env)),
+		WorkingDir: image.WorkingDir,
+		User:       image.User,
+	}
+	if len(process.Args) == 0 {
+		// If neither the image nor the task names a command, start a shell
+		process.Args = []string{"/bin/sh"}
+	}
+	if workDir != "" {
+		process.WorkingDir = workDir
+	}
+	if user != "" {
+		process.User = user
+	}
+	return process
+}
+
+// mergeEnv applies KEY=VALUE overrides on top of base, keeping the order in
+// which keys first appear
+func mergeEnv(base []string, overrides ...[]string) []string {
+	var keys []string
+	values := map[string]string{}
+	set := func(entry string) {
+		key, value, _ := strings.Cut(entry, "=")
+		if key == "" {
+			return
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	for _, e := range base {
+		set(e)
+	}
+	for _, o := range overrides {
+		for _, e := range o {
+			set(e)
+		}
+	}
+
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		env = append(env, k+"="+values[k])
+	}
+	return env
+}
+
+// envList converts an env map to KEY=VALUE pairs sorted by key
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for k, v := range env {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// lookupUser resolves a user spec of the form user[:group], where either
+// part may be a name or a numeric ID, against the contents of the image's
+// passwd and group files
+func lookupUser(passwd, group []byte, spec string) (uid, gid int, err error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+
+	uid, gid = -1, -1
+	if id, err := strconv.Atoi(userPart); err == nil {
+		uid = id
+	}
+	entries := parseColonFile(passwd)
+	for _, fields := range entries {
+		if len(fields) < 4 || (fields[0] != userPart && fields[2] != userPart) {
+			continue
+		}
+		uid, _ = strconv.Atoi(fields[2])
+		gid, _ = strconv.Atoi(fields[3])
+		break
+	}
+	if uid < 0 {
+		return 0, 0, fmt.Errorf("user %q not found in image", userPart)
+	}
+	if gid < 0 {
+		gid = 0
+	}
+
+	if hasGroup {
+		gid = -1
+		if id, err := strconv.Atoi(groupPart); err == nil {
+			gid = id
+		}
+		groups := parseColonFile(group)
+		for _, fields := range groups {
+			if len(fields) >= 3 && fields[0] == groupPart {
+				gid, _ = strconv.Atoi(fields[2])
+				break
+			}
+		}
+		if gid < 0 {
+			return 0, 0, fmt.Errorf("group %q not found in image", groupPart)
+		}
+	}
+	return uid, gid, nil
+}
+
+// parseColonFile parses a passwd(5) style file into its fields
+func parseColonFile(data []byte) [][]string {
+	var entries [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
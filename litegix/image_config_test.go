@@ -0,0 +1,204 @@
+package litegix
+
+import (
+	"reflect"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMergeImageConfig(t *testing.T) {
+	image := &ocispec.ImageConfig{
+		Entrypoint: []string{"/entrypoint.sh"},
+		Cmd:        []string{"serve", "--port", "80"},
+		Env:        []string{"PATH=/usr/bin", "MODE=image"},
+		WorkingDir: "/srv",
+		User:       "app",
+	}
+
+	cases := []struct {
+		name    string
+		image   *ocispec.ImageConfig
+		config  TaskConfig
+		taskEnv map[string]string
+		user    string
+		workDir string
+		want    imageProcess
+	}{
+		{
+			name:  "image defaults",
+			image: image,
+			want: imageProcess{
+				Args:       []string{"/entrypoint.sh", "serve", "--port", "80"},
+				Env:        []string{"PATH=/usr/bin", "MODE=image"},
+				WorkingDir: "/srv",
+				User:       "app",
+			},
+		},
+		{
+			name:   "args replace Cmd but keep Entrypoint",
+			image:  image,
+			config: TaskConfig{Args: []string{"migrate"}},
+			want: imageProcess{
+				Args:       []string{"/entrypoint.sh", "migrate"},
+				Env:        []string{"PATH=/usr/bin", "MODE=image"},
+				WorkingDir: "/srv",
+				User:       "app",
+			},
+		},
+		{
+			name:   "command replaces Entrypoint and drops Cmd",
+			image:  image,
+			config: TaskConfig{Command: "/bin/worker"},
+			want: imageProcess{
+				Args:       []string{"/bin/worker"},
+				Env:        []string{"PATH=/usr/bin", "MODE=image"},
+				WorkingDir: "/srv",
+				User:       "app",
+			},
+		},
+		{
+			name:   "command and args",
+			image:  image,
+			config: TaskConfig{Command: "/bin/sh", Args: []string{"-c", "echo hi"}},
+			want: imageProcess{
+				Args:       []string{"/bin/sh", "-c", "echo hi"},
+				Env:        []string{"PATH=/usr/bin", "MODE=image"},
+				WorkingDir: "/srv",
+				User:       "app",
+			},
+		},
+		{
+			name:    "env precedence is image, then Nomad, then driver config",
+			image:   image,
+			config:  TaskConfig{Env: map[string]string{"MODE": "driver", "EXTRA": "1"}},
+			taskEnv: map[string]string{"MODE": "nomad", "NOMAD_TASK_NAME": "web", "PATH": "/nomad/bin"},
+			want: imageProcess{
+				Args:       []string{"/entrypoint.sh", "serve", "--port", "80"},
+				Env:        []string{"PATH=/nomad/bin", "MODE=driver", "NOMAD_TASK_NAME=web", "EXTRA=1"},
+				WorkingDir: "/srv",
+				User:       "app",
+			},
+		},
+		{
+			name:    "user and work_dir override the image",
+			image:   image,
+			user:    "1000:1000",
+			workDir: "/data",
+			want: imageProcess{
+				Args:       []string{"/entrypoint.sh", "serve", "--port", "80"},
+				Env:        []string{"PATH=/usr/bin", "MODE=image"},
+				WorkingDir: "/data",
+				User:       "1000:1000",
+			},
+		},
+		{
+			name: "no command at all starts a shell",
+			want: imageProcess{
+				Args: []string{"/bin/sh"},
+				Env:  []string{},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeImageConfig(tc.image, &tc.config, tc.taskEnv, tc.user, tc.workDir)
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	cases := []struct {
+		name      string
+		base      []string
+		overrides [][]string
+		want      []string
+	}{
+		{
+			name: "keeps first appearance order",
+			base: []string{"B=1", "A=2"},
+			overrides: [][]string{
+				{"C=3", "A=override"},
+			},
+			want: []string{"B=1", "A=override", "C=3"},
+		},
+		{
+			name:      "later overrides win",
+			base:      []string{"A=base"},
+			overrides: [][]string{{"A=first"}, {"A=second"}},
+			want:      []string{"A=second"},
+		},
+		{
+			name:      "values may contain equals signs or be empty",
+			base:      []string{"OPTS=-Da=b", "EMPTY="},
+			overrides: nil,
+			want:      []string{"OPTS=-Da=b", "EMPTY="},
+		},
+		{
+			name:      "entries without a key are dropped",
+			base:      []string{"=value", "A=1"},
+			overrides: [][]string{{"=other"}},
+			want:      []string{"A=1"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeEnv(tc.base, tc.overrides...)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	passwd := []byte(`# comment
+root:x:0:0:root:/root:/bin/sh
+app:x:1000:1001::/home/app:/bin/sh
+nobody:x:65534:65534:nobody:/:/sbin/nologin
+`)
+	group := []byte(`root:x:0:
+app:x:1001:
+staff:x:50:app
+`)
+
+	cases := []struct {
+		spec    string
+		uid     int
+		gid     int
+		wantErr bool
+	}{
+		{spec: "root", uid: 0, gid: 0},
+		{spec: "app", uid: 1000, gid: 1001},
+		{spec: "1000", uid: 1000, gid: 1001},
+		{spec: "app:staff", uid: 1000, gid: 50},
+		{spec: "app:70", uid: 1000, gid: 70},
+		{spec: "2000", uid: 2000, gid: 0},
+		{spec: "2000:2000", uid: 2000, gid: 2000},
+		{spec: "missing", wantErr: true},
+		{spec: "app:missing", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.spec, func(t *testing.T) {
+			uid, gid, err := lookupUser(passwd, group, tc.spec)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %d:%d, want an error", uid, gid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupUser: %v", err)
+			}
+			if uid != tc.uid || gid != tc.gid {
+				t.Errorf("got %d:%d, want %d:%d", uid, gid, tc.uid, tc.gid)
+			}
+		})
+	}
+}
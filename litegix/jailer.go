@@ -0,0 +1,389 @@
+package litegix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Paths of the VM's sockets and kernel inside its chroot
+	jailSocketPath = "/firecracker.sock"
+	jailVsockPath  = "/vsock.sock"
+	jailKernelPath = "/vmlinux"
+
+	// linkJailFilesHandlerName names the handler placing a VM's files in
+	// its chroot
+	linkJailFilesHandlerName = "litegix.LinkJailFiles"
+)
+
+// JailerConfig is the jailer block of the plugin config
+type JailerConfig struct {
+	Enabled bool `codec:"enabled"`
+
+	// JailerPath and FirecrackerPath are the binaries run; the jailer
+	// copies firecracker into every chroot
+	JailerPath      string `codec:"jailer_path"`
+	FirecrackerPath string `codec:"firecracker_path"`
+
+	// Every task's VMM runs with a uid and gid of its own from this range
+	UIDMin int `codec:"uid_min"`
+	UIDMax int `codec:"uid_max"`
+
+	ChrootBaseDir string `codec:"chroot_base_dir"`
+	CgroupVersion string `codec:"cgroup_version"`
+	NumaNode      int    `codec:"numa_node"`
+
+	// Daemonize detaches the VMM from its session. Its console output is
+	// then lost.
+	Daemonize bool `codec:"daemonize"`
+}
+
+// validate checks the jailer config and resolves the binaries
+func (c *JailerConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.UIDMin <= 0 || c.UIDMax < c.UIDMin {
+		return fmt.Errorf("jailer uid_min and uid_max must be a positive range")
+	}
+	if c.CgroupVersion != "1" && c.CgroupVersion != "2" {
+		return fmt.Errorf("jailer cgroup_version must be 1 or 2")
+	}
+	if c.ChrootBaseDir == "" || !filepath.IsAbs(c.ChrootBaseDir) {
+		return fmt.Errorf("jailer chroot_base_dir must be an absolute path")
+	}
+
+	// The jailer is found when the driver starts VMs, but firecracker is
+	// copied from an absolute path
+	path, err := exec.LookPath(c.FirecrackerPath)
+	if err != nil {
+		return fmt.Errorf("jailer firecracker_path: %w", err)
+	}
+	c.FirecrackerPath, err = filepath.Abs(path)
+	return err
+}
+
+// vmJail is the chroot a jailed VMM runs in
+type vmJail struct {
+	ID  string
+	UID int
+
+	// Dir is the chroot on the host
+	Dir string
+
+	// taskDir holds the drive images the driver made for the task, which
+	// are linked into the chroot and given to the VMM's uid. Other images
+	// are the user's and are attached through loop devices instead.
+	taskDir string
+
+	// loops holds the loop devices attached for the VM until its VMM has
+	// opened them; they detach themselves once the VMM closes them
+	loops []*os.File
+}
+
+// jailUIDs hands out the uids jailed VMMs run as, one per task
+type jailUIDs struct {
+	lock sync.Mutex
+	used map[int]string
+}
+
+func (u *jailUIDs) allocate(taskID string, min, max int) (int, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.used == nil {
+		u.used = map[int]string{}
+	}
+	for uid := min; uid <= max; uid++ {
+		if _, ok := u.used[uid]; !ok {
+			u.used[uid] = taskID
+			return uid, nil
+		}
+	}
+	return 0, fmt.Errorf("all jailer uids from %d to %d are in use", min, max)
+}
+
+// reserve marks the uid of a recovered VM as used
+func (u *jailUIDs) reserve(uid int, taskID string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.used == nil {
+		u.used = map[int]string{}
+	}
+	u.used[uid] = taskID
+}
+
+func (u *jailUIDs) release(uid int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.used, uid)
+}
+
+// jailID derives the jailer ID of a task, which may only hold letters,
+// digits and hyphens, from its allocation and task ID
+func jailID(allocID, taskID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(taskID))
+	return fmt.Sprintf("%s-%08x", allocID, h.Sum32())
+}
+
+// newJail allocates the uid of a task's jail and removes what a previous
+// run of the task left of its chroot. vmDir is the task's VM directory.
+func (vm *firecrackerVMManager) newJail(allocID, taskID, vmDir string) (*vmJail, error) {
+	config := vm.config.Jailer
+	uid, err := vm.jailUIDs.allocate(taskID, config.UIDMin, config.UIDMax)
+	if err != nil {
+		return nil, err
+	}
+	id := jailID(allocID, taskID)
+	jail := &vmJail{
+		ID:  id,
+		UID: uid,
+		Dir: filepath.Join(config.ChrootBaseDir, filepath.Base(config.FirecrackerPath), id, "root"),
+
+		taskDir: vmDir,
+	}
+	if err := os.RemoveAll(filepath.Dir(jail.Dir)); err != nil {
+		vm.jailUIDs.release(uid)
+		return nil, fmt.Errorf("failed to remove old chroot: %w", err)
+	}
+	return jail, nil
+}
+
+// releaseJail deletes a VM's chroot and frees its uid
+func (vm *firecrackerVMManager) releaseJail(j *vmJail) error {
+	if j == nil {
+		return nil
+	}
+	j.closeLoops()
+	vm.jailUIDs.release(j.UID)
+	return os.RemoveAll(filepath.Dir(j.Dir))
+}
+
+// jail returns the chroot a VM's VMM runs in, or nil if it is not jailed
+func (v *VMInfo) jail() *vmJail {
+	if v.JailID == "" {
+		return nil
+	}
+	return &vmJail{ID: v.JailID, UID: v.JailUID, Dir: v.JailDir}
+}
+
+// jailerConfig returns the SDK's jailer config for a VM
+func (j *vmJail) jailerConfig(config JailerConfig, stdout, stderr io.Writer) *firecracker.JailerConfig {
+	return &firecracker.JailerConfig{
+		ID:             j.ID,
+		UID:            firecracker.Int(j.UID),
+		GID:            firecracker.Int(j.UID),
+		NumaNode:       firecracker.Int(config.NumaNode),
+		ExecFile:       config.FirecrackerPath,
+		JailerBinary:   config.JailerPath,
+		ChrootBaseDir:  config.ChrootBaseDir,
+		Daemonize:      config.Daemonize,
+		CgroupVersion:  config.CgroupVersion,
+		ChrootStrategy: j,
+		Stdout:         stdout,
+		Stderr:         stderr,
+	}
+}
+
+// command builds the jailer command for a VM, as the SDK would, but keeps
+// it out of the plugin's process group so it survives plugin restarts
+func (j *vmJail) command(ctx context.Context, fcConfig *firecracker.Config) *exec.Cmd {
+	jc := fcConfig.JailerCfg
+	builder := firecracker.NewJailerCommandBuilder().
+		WithID(jc.ID).
+		WithUID(*jc.UID).
+		WithGID(*jc.GID).
+		WithNumaNode(*jc.NumaNode).
+		WithExecFile(jc.ExecFile).
+		WithChrootBaseDir(jc.ChrootBaseDir).
+		WithDaemonize(jc.Daemonize).
+		WithCgroupVersion(jc.CgroupVersion).
+		WithFirecrackerArgs("--api-sock", jailSocketPath).
+		WithStdout(jc.Stdout).
+		WithStderr(jc.Stderr)
+	if jc.JailerBinary != "" {
+		builder = builder.WithBin(jc.JailerBinary)
+	}
+	if fcConfig.NetNS != "" {
+		builder = builder.WithNetNS(fcConfig.NetNS)
+	}
+
+	cmd := builder.Build(ctx)
+	if !jc.Daemonize {
+		// A daemonized jailer starts a session of its own, which a process
+		// group leader cannot do
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	return cmd
+}
+
+// AdaptHandlers places the VM's files in its chroot once the jailer has
+// created it, before the VM is configured
+func (j *vmJail) AdaptHandlers(handlers *firecracker.Handlers) error {
+	if !handlers.FcInit.Has(firecracker.CreateLogFilesHandlerName) {
+		return firecracker.ErrRequiredHandlerMissing
+	}
+	handlers.FcInit = handlers.FcInit.AppendAfter(
+		firecracker.CreateLogFilesHandlerName,
+		firecracker.Handler{Name: linkJailFilesHandlerName, Fn: j.linkFiles},
+	)
+	return nil
+}
+
+// linkFiles hard-links the kernel and the task's drive images into the
+// chroot and points the VM config at them. The task's images are given to
+// the VMM's uid, while block devices and the user's volume images get a
+// device node of their own.
+func (j *vmJail) linkFiles(ctx context.Context, m *firecracker.Machine) error {
+	if err := linkOrCopy(m.Cfg.KernelImagePath, filepath.Join(j.Dir, jailKernelPath)); err != nil {
+		return fmt.Errorf("failed to place kernel in chroot: %w", err)
+	}
+	m.Cfg.KernelImagePath = jailKernelPath
+
+	for i, drive := range m.Cfg.Drives {
+		hostPath := firecracker.StringValue(drive.PathOnHost)
+		jailPath := "/" + firecracker.StringValue(drive.DriveID)
+		readOnly := firecracker.BoolValue(drive.IsReadOnly)
+		if err := j.placeDrive(hostPath, filepath.Join(j.Dir, jailPath), readOnly); err != nil {
+			return fmt.Errorf("failed to place drive %s in chroot: %w", hostPath, err)
+		}
+		m.Cfg.Drives[i].PathOnHost = firecracker.String(jailPath)
+	}
+	return nil
+}
+
+func (j *vmJail) placeDrive(hostPath, path string, readOnly bool) error {
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+	var dev uint64
+	switch {
+	case fi.Mode()&os.ModeDevice != 0:
+		dev = fi.Sys().(*syscall.Stat_t).Rdev
+	case j.ownsDrive(hostPath):
+		if err := os.Link(hostPath, path); err != nil {
+			if errors.Is(err, unix.EXDEV) {
+				return fmt.Errorf("rootfs_base_path must be on the same filesystem as chroot_base_dir: %w", err)
+			}
+			return err
+		}
+		return os.Chown(path, j.UID, j.UID)
+	default:
+		// Neither re-own the user's image nor require it on the chroot's
+		// filesystem
+		loop, err := attachLoop(hostPath, readOnly)
+		if err != nil {
+			return fmt.Errorf("failed to attach loop device: %w", err)
+		}
+		j.loops = append(j.loops, loop)
+		fi, err := loop.Stat()
+		if err != nil {
+			return err
+		}
+		dev = fi.Sys().(*syscall.Stat_t).Rdev
+	}
+	if err := unix.Mknod(path, unix.S_IFBLK|0600, int(dev)); err != nil {
+		return err
+	}
+	return os.Chown(path, j.UID, j.UID)
+}
+
+// ownsDrive reports whether a drive image is one the driver made for the
+// task
+func (j *vmJail) ownsDrive(hostPath string) bool {
+	rel, err := filepath.Rel(j.taskDir, hostPath)
+	return err == nil && j.taskDir != "" && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// closeLoops lets go of the VM's loop devices. Those the VMM has open stay
+// attached until it exits.
+func (j *vmJail) closeLoops() {
+	for _, loop := range j.loops {
+		loop.Close()
+	}
+	j.loops = nil
+}
+
+// attachLoop attaches a file to a free loop device that detaches itself
+// when its last user closes it
+func attachLoop(path string, readOnly bool) (*os.File, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	backing, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer backing.Close()
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+
+	// Another process may take the free device before it is attached
+	for attempt := 0; attempt < 10; attempt++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, err
+		}
+		loop, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", n), flag, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+			loop.Close()
+			if errors.Is(err, unix.EBUSY) {
+				continue
+			}
+			return nil, err
+		}
+		info := unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR}
+		copy(info.File_name[:len(info.File_name)-1], path)
+		if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), &info); err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return nil, err
+		}
+		return loop, nil
+	}
+	return nil, fmt.Errorf("no free loop device")
+}
+
+// linkOrCopy hard-links src to dst, copying it when they are on different
+// filesystems
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if !errors.Is(err, unix.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
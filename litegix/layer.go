@@ -0,0 +1,388 @@
+package litegix
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutPrefix marks a file deleted from lower layers
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaqueDir marks a directory whose lower layer contents are
+	// hidden
+	whiteoutOpaqueDir = ".wh..wh..opq"
+
+	// paxXattrPrefix prefixes extended attributes in PAX headers
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// layerApplier unpacks image layers on top of each other into a root
+// directory following the OCI image layer specification, so the result
+// matches what a container runtime shows for the image
+type layerApplier struct {
+	root string
+
+	// privileged is set when running as root, in which case ownership,
+	// device nodes and trusted xattrs are restored as well
+	privileged bool
+
+	// fixups records the metadata an unprivileged applier cannot set on
+	// the host, to be written into the rootfs image instead. It is nil
+	// when running privileged.
+	fixups *metadataFixups
+}
+
+func newLayerApplier(root string) *layerApplier {
+	a := &layerApplier{
+		root:       root,
+		privileged: os.Geteuid() == 0,
+	}
+	if !a.privileged {
+		a.fixups = newMetadataFixups()
+	}
+	return a
+}
+
+// dirTimes records a directory's timestamps, applied once the layer is
+// fully unpacked since adding entries updates them
+type dirTimes struct {
+	path  string
+	atime time.Time
+	mtime time.Time
+}
+
+// Apply unpacks the gzip, zstd or uncompressed layer tarball at layerPath,
+// processing whiteouts against the layers applied before it
+func (a *layerApplier) Apply(ctx context.Context, layerPath string) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return fmt.Errorf("failed to open layer: %w", err)
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Entries written by this layer, which opaque markers must not hide
+	created := map[string]bool{}
+	var dirs []dirTimes
+
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer: %w", err)
+		}
+
+		// Entry names end up in debugfs scripts when running unprivileged
+		if hasControlChars(hdr.Name) {
+			return fmt.Errorf("invalid path %q in layer: contains control characters", hdr.Name)
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := path.Split(name)
+
+		parent, err := securejoin.SecureJoin(a.root, dir)
+		if err != nil {
+			return fmt.Errorf("invalid path %q in layer: %w", hdr.Name, err)
+		}
+
+		switch {
+		case base == whiteoutOpaqueDir:
+			if err := a.clearDir(parent, path.Clean(dir), created); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			target := filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix))
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to apply whiteout %q: %w", hdr.Name, err)
+			}
+			a.forget(target)
+			continue
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %q: %w", hdr.Name, err)
+		}
+		target := filepath.Join(parent, base)
+		if err := a.applyEntry(hdr, tr, target); err != nil {
+			return fmt.Errorf("failed to unpack %q: %w", hdr.Name, err)
+		}
+		created[name] = true
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: target, atime: hdr.AccessTime, mtime: hdr.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		setTimes(dirs[i].path, dirs[i].atime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// applyEntry creates a single non-whiteout entry at target, replacing
+// whatever a lower layer put there unless both are directories
+func (a *layerApplier) applyEntry(hdr *tar.Header, r io.Reader, target string) error {
+	if fi, err := os.Lstat(target); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			a.forget(target)
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+
+	case tar.TypeLink:
+		// Resolve the link's directory inside the root, but not the
+		// final component, so hard links to symlinks stay links to them
+		linkName := path.Clean("/" + hdr.Linkname)
+		linkDir, linkBase := path.Split(linkName)
+		source, err := securejoin.SecureJoin(a.root, linkDir)
+		if err != nil {
+			return err
+		}
+		source = filepath.Join(source, linkBase)
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+		// The link shares the source's inode and metadata, which must
+		// not be reset through the link's path in the rootfs image
+		if a.fixups != nil {
+			a.fixups.link(a.rel(target), a.rel(source))
+		}
+		return nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(mode.Perm())
+		var devType byte
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			devMode |= unix.S_IFCHR
+			devType = 'c'
+		case tar.TypeBlock:
+			devMode |= unix.S_IFBLK
+			devType = 'b'
+		case tar.TypeFifo:
+			devMode |= unix.S_IFIFO
+			devType = 'p'
+		}
+		if !a.privileged && hdr.Typeflag != tar.TypeFifo {
+			// Unprivileged callers cannot create device nodes, so they are
+			// created in the rootfs image instead
+			a.fixups.addDevice(a.rel(target), deviceNode{
+				Type:  devType,
+				Major: hdr.Devmajor,
+				Minor: hdr.Devminor,
+				Mode:  mode,
+				UID:   hdr.Uid,
+				GID:   hdr.Gid,
+			})
+			return nil
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(target, devMode, dev); err != nil {
+			return err
+		}
+
+	case tar.TypeXGlobalHeader:
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+
+	if a.privileged {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	} else {
+		a.fixups.setOwner(a.rel(target), hdr.Uid, hdr.Gid)
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if hasControlChars(attr) {
+			return fmt.Errorf("invalid xattr name %q", attr)
+		}
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			// trusted.* and security.* need privileges, and not every
+			// filesystem supports xattrs; neither should fail the pull
+			if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOTSUP) {
+				if a.fixups != nil {
+					a.fixups.setXattr(a.rel(target), attr, value)
+				}
+				continue
+			}
+			return fmt.Errorf("failed to set xattr %s: %w", attr, err)
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		hostMode := mode
+		if !a.privileged {
+			// Read-only directories would block later entries and
+			// unreadable files could not be copied into the rootfs, so
+			// the host copy stays accessible to its owner and the real
+			// mode is set in the rootfs image, after the last layer
+			hostMode |= 0o600
+			if hdr.Typeflag == tar.TypeDir {
+				hostMode |= 0o100
+			}
+			a.fixups.setMode(a.rel(target), rawMode(mode, hdr.Typeflag))
+		}
+		// Chmod after chown, which clears setuid and setgid bits
+		if err := os.Chmod(target, hostMode); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		setTimes(target, hdr.AccessTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// rawMode converts the mode of a tar entry into the raw i_mode of an inode
+func rawMode(mode os.FileMode, typeflag byte) uint32 {
+	switch typeflag {
+	case tar.TypeDir:
+		return inodeMode(mode, true)
+	case tar.TypeFifo:
+		return inodeMode(mode, false)&^0o170000 | 0o010000
+	default:
+		return inodeMode(mode, false)
+	}
+}
+
+// clearDir implements an opaque whiteout by removing everything in dir that
+// lower layers created, keeping entries from the current layer
+func (a *layerApplier) clearDir(hostDir, layerDir string, created map[string]bool) error {
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to apply opaque whiteout in %q: %w", layerDir, err)
+	}
+	for _, e := range entries {
+		if created[path.Join(layerDir, e.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(hostDir, e.Name())); err != nil {
+			return fmt.Errorf("failed to apply opaque whiteout in %q: %w", layerDir, err)
+		}
+		a.forget(filepath.Join(hostDir, e.Name()))
+	}
+	return nil
+}
+
+// rel returns target relative to the root, as used for metadata fixups
+func (a *layerApplier) rel(target string) string {
+	rel, _ := filepath.Rel(a.root, target)
+	return filepath.ToSlash(rel)
+}
+
+// forget drops recorded fixups for a removed path
+func (a *layerApplier) forget(target string) {
+	if a.fixups != nil {
+		a.fixups.remove(a.rel(target))
+	}
+}
+
+// decompress detects the layer compression from its magic bytes
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip layer: %w", err)
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd layer: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// setTimes sets the timestamps of path without following symlinks. Errors
+// are ignored as timestamps are cosmetic.
+func setTimes(path string, atime, mtime time.Time) {
+	if mtime.IsZero() {
+		return
+	}
+	if atime.IsZero() {
+		atime = mtime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,365 @@
+package litegix
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testEntry is a tar entry of a test layer. Entries default to regular
+// files holding Body.
+type testEntry struct {
+	Name     string
+	Type     byte
+	Body     string
+	Linkname string
+	Mode     int64
+	Uid      int
+}
+
+// buildLayer returns an uncompressed tarball of entries
+func buildLayer(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.Name,
+			Typeflag: e.Type,
+			Linkname: e.Linkname,
+			Mode:     e.Mode,
+			Uid:      e.Uid,
+			Gid:      e.Uid,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Mode = 0755
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.Body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// applyLayers applies each layer in turn with a, stopping at the first error
+func applyLayers(t *testing.T, a *layerApplier, layers ...[]byte) error {
+	t.Helper()
+	dir := t.TempDir()
+	for i, layer := range layers {
+		path := filepath.Join(dir, fmt.Sprintf("layer%d", i))
+		if err := os.WriteFile(path, layer, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Apply(context.Background(), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestLayerApplier_Apply(t *testing.T) {
+	cases := []struct {
+		name   string
+		layers [][]testEntry
+
+		// exist and missing are paths relative to the root
+		exist   []string
+		missing []string
+		check   func(t *testing.T, root string)
+	}{
+		{
+			name: "whiteout file",
+			layers: [][]testEntry{
+				{{Name: "etc/", Type: tar.TypeDir}, {Name: "etc/a"}, {Name: "etc/b"}},
+				{{Name: "etc/.wh.a"}},
+			},
+			exist:   []string{"etc/b"},
+			missing: []string{"etc/a", "etc/.wh.a"},
+		},
+		{
+			name: "whiteout directory",
+			layers: [][]testEntry{
+				{{Name: "var/", Type: tar.TypeDir}, {Name: "var/cache/", Type: tar.TypeDir}, {Name: "var/cache/x"}},
+				{{Name: "var/.wh.cache"}},
+			},
+			exist:   []string{"var"},
+			missing: []string{"var/cache"},
+		},
+		{
+			name: "opaque directory keeps entries of its own layer",
+			layers: [][]testEntry{
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/old"}, {Name: "app/sub/", Type: tar.TypeDir}, {Name: "app/sub/deep"}},
+				{{Name: "app/", Type: tar.TypeDir}, {Name: "app/new"}, {Name: "app/.wh..wh..opq"}},
+			},
+			exist:   []string{"app/new"},
+			missing: []string{"app/old", "app/sub", "app/.wh..wh..opq"},
+		},
+		{
+			name: "file replaces directory of lower layer",
+			layers: [][]testEntry{
+				{{Name: "x/", Type: tar.TypeDir}, {Name: "x/y"}},
+				{{Name: "x", Body: "file"}},
+			},
+			check: func(t *testing.T, root string) {
+				data, err := os.ReadFile(filepath.Join(root, "x"))
+				if err != nil || string(data) != "file" {
+					t.Errorf("x = %q, %v; want the file of the upper layer", data, err)
+				}
+			},
+		},
+		{
+			name: "hardlink",
+			layers: [][]testEntry{
+				{{Name: "bin/", Type: tar.TypeDir}, {Name: "bin/a", Body: "data"}, {Name: "bin/b", Type: tar.TypeLink, Linkname: "bin/a"}},
+			},
+			check: func(t *testing.T, root string) {
+				a, errA := os.Stat(filepath.Join(root, "bin/a"))
+				b, errB := os.Stat(filepath.Join(root, "bin/b"))
+				if errA != nil || errB != nil {
+					t.Fatalf("stat: %v, %v", errA, errB)
+				}
+				if a.Sys().(*syscall.Stat_t).Ino != b.Sys().(*syscall.Stat_t).Ino {
+					t.Error("bin/b is not a hard link to bin/a")
+				}
+			},
+		},
+		{
+			name: "hardlink to symlink stays a link to the symlink",
+			layers: [][]testEntry{
+				{{Name: "s", Type: tar.TypeSymlink, Linkname: "/target"}, {Name: "h", Type: tar.TypeLink, Linkname: "s"}},
+			},
+			check: func(t *testing.T, root string) {
+				target, err := os.Readlink(filepath.Join(root, "h"))
+				if err != nil || target != "/target" {
+					t.Errorf("h links to %q, %v; want /target", target, err)
+				}
+			},
+		},
+		{
+			name: "symlinked parent cannot escape the root",
+			layers: [][]testEntry{
+				{{Name: "escape", Type: tar.TypeSymlink, Linkname: "../../outside"}},
+				{{Name: "escape/file", Body: "data"}},
+			},
+			check: func(t *testing.T, root string) {
+				if _, err := os.Stat(filepath.Join(root, "..", "outside", "file")); err == nil {
+					t.Fatal("entry was written outside the root")
+				}
+				if _, err := os.Stat(filepath.Join(root, "outside", "file")); err != nil {
+					t.Errorf("entry was not confined to the root: %v", err)
+				}
+			},
+		},
+		{
+			name: "absolute symlinked parent resolves inside the root",
+			layers: [][]testEntry{
+				{{Name: "abs", Type: tar.TypeSymlink, Linkname: "/etc"}},
+				{{Name: "abs/file", Body: "data"}},
+			},
+			exist: []string{"etc/file"},
+		},
+		{
+			name: "dot-dot names stay inside the root",
+			layers: [][]testEntry{
+				{{Name: "../../evil", Body: "data"}},
+			},
+			exist: []string{"evil"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The root is nested so escapes land in a directory of the test
+			root := filepath.Join(t.TempDir(), "a", "root")
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			a := &layerApplier{root: root, privileged: os.Geteuid() == 0}
+			if !a.privileged {
+				a.fixups = newMetadataFixups()
+			}
+
+			var layers [][]byte
+			for _, entries := range tc.layers {
+				layers = append(layers, buildLayer(t, entries))
+			}
+			if err := applyLayers(t, a, layers...); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			for _, p := range tc.exist {
+				if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+					t.Errorf("%s missing: %v", p, err)
+				}
+			}
+			for _, p := range tc.missing {
+				if _, err := os.Lstat(filepath.Join(root, p)); err == nil {
+					t.Errorf("%s exists", p)
+				}
+			}
+			if tc.check != nil {
+				tc.check(t, root)
+			}
+		})
+	}
+}
+
+func TestLayerApplier_ApplyErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []testEntry
+		want    string
+	}{
+		{
+			name:    "control characters in name",
+			entries: []testEntry{{Name: "evil\nrm /etc"}},
+			want:    "control characters",
+		},
+		{
+			name:    "hardlink to missing file",
+			entries: []testEntry{{Name: "h", Type: tar.TypeLink, Linkname: "../../etc/passwd"}},
+			want:    "failed to unpack",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &layerApplier{root: t.TempDir(), privileged: true}
+			err := applyLayers(t, a, buildLayer(t, tc.entries))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Apply error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLayerApplier_Unprivileged(t *testing.T) {
+	root := t.TempDir()
+	a := &layerApplier{root: root, fixups: newMetadataFixups()}
+	layer := buildLayer(t, []testEntry{
+		{Name: "ro/", Type: tar.TypeDir, Mode: 0555},
+		{Name: "ro/secret", Body: "data", Mode: 0400},
+		{Name: "ro/none", Body: "data", Mode: 01000},
+	})
+	if err := applyLayers(t, a, layer); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	// The host copies stay accessible to their owner
+	for p, want := range map[string]os.FileMode{"ro": 0755, "ro/secret": 0600, "ro/none": 0600} {
+		fi, err := os.Stat(filepath.Join(root, p))
+		if err != nil {
+			t.Fatalf("stat %s: %v", p, err)
+		}
+		if fi.Mode().Perm()&want != want {
+			t.Errorf("%s host mode = %o, want at least %o", p, fi.Mode().Perm(), want)
+		}
+	}
+
+	// and the real modes are set in the image
+	for p, want := range map[string]uint32{"ro": 0o40555, "ro/secret": 0o100400, "ro/none": 0o101000} {
+		if got := a.fixups.modes[p]; got != want {
+			t.Errorf("%s recorded mode = %o, want %o", p, got, want)
+		}
+	}
+}
+
+func TestLayerApplier_UnprivilegedHardlinkOwner(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	// The link sorts before its source, so its fixups are written first
+	root := t.TempDir()
+	a := &layerApplier{root: root, fixups: newMetadataFixups()}
+	layer := buildLayer(t, []testEntry{
+		{Name: "data/", Type: tar.TypeDir, Uid: 1000},
+		{Name: "data/b", Body: "data", Mode: 0640, Uid: 1000},
+		{Name: "data/a", Type: tar.TypeLink, Linkname: "data/b"},
+	})
+	if err := applyLayers(t, a, layer); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := a.fixups.owners["data/a"]; got != [2]int{1000, 1000} {
+		t.Errorf("link owner = %v, want the source's", got)
+	}
+
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if _, err := buildExt4(context.Background(), root, image, a.fixups); err != nil {
+		t.Fatalf("buildExt4: %v", err)
+	}
+	for _, p := range []string{"/data/a", "/data/b"} {
+		out, err := exec.Command("debugfs", "-R", "stat "+p, image).Output()
+		if err != nil {
+			t.Fatalf("debugfs stat %s: %v", p, err)
+		}
+		if !regexp.MustCompile(`User:\s+1000\s+Group:\s+1000\s`).Match(out) {
+			t.Errorf("%s is not owned by 1000:1000 in the image:\n%s", p, out)
+		}
+		if !regexp.MustCompile(`Mode:\s+0?0640\s`).Match(out) {
+			t.Errorf("%s does not have mode 0640 in the image:\n%s", p, out)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	layer := buildLayer(t, []testEntry{{Name: "file", Body: "data"}})
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(layer)
+	gw.Close()
+
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(layer)
+	zw.Close()
+
+	for name, data := range map[string][]byte{"none": layer, "gzip": gz.Bytes(), "zstd": zst.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			r, err := decompress(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, layer) {
+				t.Error("decompressed layer differs from the original")
+			}
+		})
+	}
+}
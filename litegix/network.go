@@ -0,0 +1,289 @@
+package litegix
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// netNSDir holds the network namespaces created for VMs, one per VM
+	// named after its ID
+	netNSDir = "/var/run/netns"
+
+	// cniIfName is the interface CNI creates in a VM's network namespace,
+	// which tc-redirect-tap connects to the VM's tap device
+	cniIfName = "veth0"
+
+	// guestIfName is the interface the guest kernel configures
+	guestIfName = "eth0"
+
+	// cniCacheDir is where CNI caches results, needed to tear networks down
+	cniCacheDir = "/var/lib/cni"
+
+	// Ways a VM is connected to the network
+	networkModeCNI   = "cni"
+	networkModeGroup = "group"
+
+	// maxNameservers is how many nameservers the ip= boot parameter holds
+	maxNameservers = 2
+)
+
+// groupNetwork is the point to point link between a VM and its allocation's
+// network namespace. Every task in the group gets its own tap device and
+// link local /30, both derived from the task name so restarts reuse them.
+type groupNetwork struct {
+	TapName string
+	HostIP  net.IP
+	GuestIP net.IP
+	Mask    net.IPMask
+}
+
+func newGroupNetwork(taskName string) *groupNetwork {
+	h := fnv.New32a()
+	h.Write([]byte(taskName))
+	// One of the /30s in 169.254.0.0/16, skipping the first
+	index := h.Sum32()%(1<<14-1) + 1
+
+	base := make(net.IP, 4)
+	binary.BigEndian.PutUint32(base, 169<<24|254<<16|index<<2)
+	host := make(net.IP, 4)
+	binary.BigEndian.PutUint32(host, binary.BigEndian.Uint32(base)+1)
+	guest := make(net.IP, 4)
+	binary.BigEndian.PutUint32(guest, binary.BigEndian.Uint32(base)+2)
+
+	return &groupNetwork{
+		TapName: fmt.Sprintf("fctap%d", index),
+		HostIP:  host,
+		GuestIP: guest,
+		Mask:    net.CIDRMask(30, 32),
+	}
+}
+
+// networkInterfaces returns the interfaces of a VM connected to the
+// configured CNI network, or nil if VMs get no network. The SDK creates the
+// network namespace, runs the CNI plugins in it and passes the resulting
+// address to the guest kernel with the ip= boot parameter.
+func (vm *firecrackerVMManager) networkInterfaces() firecracker.NetworkInterfaces {
+	if vm.config.CNINetwork == "" {
+		return nil
+	}
+	return firecracker.NetworkInterfaces{{
+		CNIConfiguration: &firecracker.CNIConfiguration{
+			NetworkName: vm.config.CNINetwork,
+			IfName:      cniIfName,
+			VMIfName:    guestIfName,
+			BinPath:     filepath.SplitList(vm.config.CNIPath),
+			ConfDir:     vm.config.CNIConfigDir,
+		},
+	}}
+}
+
+// guestIP returns the address CNI assigned to a started VM
+func guestIP(machine *firecracker.Machine) string {
+	for _, iface := range machine.Cfg.NetworkInterfaces {
+		if iface.StaticConfiguration == nil || iface.StaticConfiguration.IPConfiguration == nil {
+			continue
+		}
+		return iface.StaticConfiguration.IPConfiguration.IPAddr.IP.String()
+	}
+	return ""
+}
+
+// teardownNetwork deletes a VM's CNI network and its network namespace.
+// The SDK does so itself when a VM it started exits, but not for VMs
+// recovered after a plugin restart. Deleting twice is harmless.
+func (vm *firecrackerVMManager) teardownNetwork(ctx context.Context, vmInfo *VMInfo) error {
+	if vmInfo.NetworkMode != networkModeCNI {
+		// Group network namespaces belong to Nomad and go away with the
+		// allocation, along with the VM's tap device
+		return nil
+	}
+
+	var errs []error
+	networkConf, err := libcni.LoadConfList(vm.config.CNIConfigDir, vm.config.CNINetwork)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to load CNI network %q: %w", vm.config.CNINetwork, err))
+	} else {
+		cni := libcni.NewCNIConfigWithCacheDir(filepath.SplitList(vm.config.CNIPath), filepath.Join(cniCacheDir, vmInfo.VMID), nil)
+		runtimeConf := &libcni.RuntimeConf{
+			ContainerID: vmInfo.VMID,
+			NetNS:       vmInfo.NetNS,
+			IfName:      cniIfName,
+		}
+		if err := cni.DelNetworkList(ctx, networkConf, runtimeConf); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete CNI network: %w", err))
+		}
+	}
+
+	if err := unix.Unmount(vmInfo.NetNS, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		errs = append(errs, fmt.Errorf("failed to unmount network namespace: %w", err))
+	}
+	if err := os.Remove(vmInfo.NetNS); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, fmt.Errorf("failed to remove network namespace: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// setup creates the VM's tap device in the allocation's network namespace
+// at netNS. Guest traffic leaving the namespace is masqueraded behind the
+// allocation's address, and connections to the host end of the link are
+// passed to the namespace's loopback interface, where Consul Connect
+// sidecars listen for upstreams.
+func (g *groupNetwork) setup(netNS string) error {
+	hostCIDR := (&net.IPNet{IP: g.HostIP, Mask: g.Mask}).String()
+	guestIP := g.GuestIP.String() + "/32"
+	hostIP := g.HostIP.String() + "/32"
+
+	return ns.WithNetNSPath(netNS, func(ns.NetNS) error {
+		// A previous run of the task may have left its tap device behind
+		exec.Command("ip", "link", "del", g.TapName).Run()
+
+		commands := [][]string{
+			{"ip", "tuntap", "add", "dev", g.TapName, "mode", "tap"},
+			{"ip", "addr", "add", hostCIDR, "dev", g.TapName},
+			{"ip", "link", "set", g.TapName, "up"},
+		}
+		for _, args := range commands {
+			if err := runCommand(args...); err != nil {
+				return err
+			}
+		}
+
+		// Network sysctls apply to the namespace of the thread opening them
+		sysctls := map[string]string{
+			"/proc/sys/net/ipv4/ip_forward":                            "1",
+			"/proc/sys/net/ipv4/conf/" + g.TapName + "/route_localnet": "1",
+		}
+		for path, value := range sysctls {
+			if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+				return fmt.Errorf("failed to set %s: %w", path, err)
+			}
+		}
+
+		rules := [][]string{
+			{"POSTROUTING", "-s", guestIP, "!", "-o", g.TapName, "-j", "MASQUERADE"},
+			{"PREROUTING", "-i", g.TapName, "-d", hostIP, "-p", "tcp", "-j", "DNAT", "--to-destination", "127.0.0.1"},
+			{"PREROUTING", "-i", g.TapName, "-d", hostIP, "-p", "udp", "-j", "DNAT", "--to-destination", "127.0.0.1"},
+		}
+		for _, rule := range rules {
+			if err := ensureNATRule(rule...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// networkInterfaces returns the VM's interface on the group network. The
+// guest's address is passed in the ip= boot parameter.
+func (g *groupNetwork) networkInterfaces(nameservers []string) firecracker.NetworkInterfaces {
+	return firecracker.NetworkInterfaces{{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			HostDevName: g.TapName,
+			IPConfiguration: &firecracker.IPConfiguration{
+				IPAddr:      net.IPNet{IP: g.GuestIP, Mask: g.Mask},
+				Gateway:     g.HostIP,
+				Nameservers: nameservers,
+				IfName:      guestIfName,
+			},
+		},
+	}}
+}
+
+// upstreamEnv points Consul Connect upstream variables, which name the
+// sidecar on the namespace's loopback, at the host end of the VM's link
+func (g *groupNetwork) upstreamEnv(env map[string]string) map[string]string {
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		if strings.HasPrefix(k, "NOMAD_UPSTREAM_ADDR_") || strings.HasPrefix(k, "NOMAD_UPSTREAM_IP_") {
+			v = strings.Replace(v, "127.0.0.1", g.HostIP.String(), 1)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// groupNameservers returns the nameservers for a VM on a group network:
+// those of the group's dns block, or else the host's that are reachable
+// from the namespace
+func groupNameservers(dns *drivers.DNSConfig) []string {
+	var servers []string
+	if dns != nil && len(dns.Servers) > 0 {
+		servers = dns.Servers
+	} else {
+		servers = hostNameservers()
+	}
+	var ipv4 []string
+	for _, s := range servers {
+		// The ip= boot parameter only takes IPv4 nameservers
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil && !ip.IsLoopback() {
+			ipv4 = append(ipv4, s)
+		}
+	}
+	if len(ipv4) > maxNameservers {
+		ipv4 = ipv4[:maxNameservers]
+	}
+	return ipv4
+}
+
+// hostNameservers returns the nameservers in the host's resolv.conf
+func hostNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// ensureNATRule appends a rule to a chain of the nat table unless it is
+// already there
+func ensureNATRule(rule ...string) error {
+	check := append([]string{"iptables", "-t", "nat", "-C"}, rule...)
+	if exec.Command(check[0], check[1:]...).Run() == nil {
+		return nil
+	}
+	return runCommand(append([]string{"iptables", "-t", "nat", "-A"}, rule...)...)
+}
+
+// deleteNATRule removes a rule from a chain of the nat table if it is there
+func deleteNATRule(rule ...string) error {
+	check := append([]string{"iptables", "-t", "nat", "-C"}, rule...)
+	if exec.Command(check[0], check[1:]...).Run() != nil {
+		return nil
+	}
+	return runCommand(append([]string{"iptables", "-t", "nat", "-D"}, rule...)...)
+}
+
+// runCommand runs a command, returning its output on failure
+func runCommand(args ...string) error {
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
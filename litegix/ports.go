@@ -0,0 +1,158 @@
+package litegix
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// portProtocols are the protocols forwarded for every port, as Nomad ports
+// do not name one
+var portProtocols = []string{"tcp", "udp"}
+
+// portMapping forwards a port allocated to the task to the guest
+type portMapping struct {
+	Label     string
+	HostIP    string
+	HostPort  int
+	GuestPort int
+}
+
+// taskPortMappings resolves the port labels of the task's ports option
+// against the ports Nomad allocated to it. A port's to value is the guest
+// port, which defaults to the allocated port.
+func taskPortMappings(labels []string, resources *drivers.Resources) ([]portMapping, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	if resources == nil || resources.Ports == nil {
+		return nil, fmt.Errorf("task has no ports allocated, but ports is set")
+	}
+
+	mappings := make([]portMapping, 0, len(labels))
+	for _, label := range labels {
+		port, ok := resources.Ports.Get(label)
+		if !ok {
+			return nil, fmt.Errorf("port %q is not allocated to the task", label)
+		}
+		guestPort := port.To
+		if guestPort <= 0 {
+			guestPort = port.Value
+		}
+		mappings = append(mappings, portMapping{
+			Label:     label,
+			HostIP:    port.HostIP,
+			HostPort:  port.Value,
+			GuestPort: guestPort,
+		})
+	}
+	return mappings, nil
+}
+
+// portRules returns the nat table rules forwarding a VM's ports.
+//
+// On a CNI network the rules live in the host's namespace and forward the
+// allocated host ports to the guest. On a group network Nomad already
+// forwards them to the allocation's namespace, where the rules pass the
+// mapped ports on to the guest. Connections to those ports on the
+// namespace's loopback interface, made by Consul Connect sidecars, are
+// forwarded too.
+func portRules(vmInfo *VMInfo) [][]string {
+	var rules [][]string
+	for _, m := range vmInfo.PortMappings {
+		for _, proto := range portProtocols {
+			switch vmInfo.NetworkMode {
+			case networkModeCNI:
+				target := net.JoinHostPort(vmInfo.GuestIP, strconv.Itoa(m.GuestPort))
+				match := []string{"-p", proto, "--dport", strconv.Itoa(m.HostPort)}
+				if ip := net.ParseIP(m.HostIP); ip != nil && !ip.IsUnspecified() {
+					match = append([]string{"-d", m.HostIP + "/32"}, match...)
+				} else {
+					match = append([]string{"-m", "addrtype", "--dst-type", "LOCAL"}, match...)
+				}
+				dnat := []string{"-j", "DNAT", "--to-destination", target}
+				rules = append(rules,
+					concat([]string{"PREROUTING"}, match, dnat),
+					concat([]string{"OUTPUT"}, match, dnat),
+				)
+			case networkModeGroup:
+				tap := vmInfo.TapName
+				target := net.JoinHostPort(vmInfo.GuestIP, strconv.Itoa(m.GuestPort))
+				port := strconv.Itoa(m.GuestPort)
+				rules = append(rules,
+					[]string{"PREROUTING", "!", "-i", tap, "-p", proto, "--dport", port, "-j", "DNAT", "--to-destination", target},
+					[]string{"OUTPUT", "-d", "127.0.0.1/32", "-p", proto, "--dport", port, "-j", "DNAT", "--to-destination", target},
+				)
+			}
+		}
+	}
+	if vmInfo.NetworkMode == networkModeGroup && len(rules) > 0 {
+		// Replies to loopback connections must come back through the
+		// namespace, so their source is rewritten to the tap's address
+		rules = append(rules, []string{"POSTROUTING", "-s", "127.0.0.0/8", "-o", vmInfo.TapName, "-j", "MASQUERADE"})
+	}
+	return rules
+}
+
+// setupPorts forwards a VM's ports to the guest
+func (vm *firecrackerVMManager) setupPorts(vmInfo *VMInfo) error {
+	if len(vmInfo.PortMappings) == 0 {
+		return nil
+	}
+	if vmInfo.GuestIP == "" {
+		return fmt.Errorf("ports are set, but the VM has no network")
+	}
+	return inNetNS(vmInfo, func() error {
+		for _, rule := range portRules(vmInfo) {
+			if err := ensureNATRule(rule...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// teardownPorts removes the rules forwarding a VM's ports
+func (vm *firecrackerVMManager) teardownPorts(vmInfo *VMInfo) error {
+	if len(vmInfo.PortMappings) == 0 || vmInfo.GuestIP == "" {
+		return nil
+	}
+	if vmInfo.NetworkMode == networkModeGroup {
+		if _, err := os.Stat(vmInfo.NetNS); os.IsNotExist(err) {
+			// The rules went away with the allocation's namespace
+			return nil
+		}
+	}
+	return inNetNS(vmInfo, func() error {
+		var errs []error
+		for _, rule := range portRules(vmInfo) {
+			if err := deleteNATRule(rule...); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// inNetNS runs fn in the namespace holding a VM's port rules
+func inNetNS(vmInfo *VMInfo, fn func() error) error {
+	if vmInfo.NetworkMode != networkModeGroup {
+		return fn()
+	}
+	return ns.WithNetNSPath(vmInfo.NetNS, func(ns.NetNS) error {
+		return fn()
+	})
+}
+
+func concat(parts ...[]string) []string {
+	var out []string
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package litegix
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+func TestTaskPortMappings(t *testing.T) {
+	resources := &drivers.Resources{
+		Ports: &structs.AllocatedPorts{
+			{Label: "http", Value: 25000, To: 80, HostIP: "10.0.0.5"},
+			{Label: "metrics", Value: 25001, HostIP: "10.0.0.5"},
+		},
+	}
+
+	cases := []struct {
+		name      string
+		labels    []string
+		resources *drivers.Resources
+		want      []portMapping
+		wantErr   string
+	}{
+		{
+			name: "no ports",
+		},
+		{
+			name:      "to is the guest port",
+			labels:    []string{"http"},
+			resources: resources,
+			want:      []portMapping{{Label: "http", HostIP: "10.0.0.5", HostPort: 25000, GuestPort: 80}},
+		},
+		{
+			name:      "guest port defaults to the allocated port",
+			labels:    []string{"metrics"},
+			resources: resources,
+			want:      []portMapping{{Label: "metrics", HostIP: "10.0.0.5", HostPort: 25001, GuestPort: 25001}},
+		},
+		{
+			name:      "unknown label",
+			labels:    []string{"grpc"},
+			resources: resources,
+			wantErr:   `port "grpc" is not allocated`,
+		},
+		{
+			name:    "no allocated ports",
+			labels:  []string{"http"},
+			wantErr: "task has no ports allocated",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := taskPortMappings(tc.labels, tc.resources)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("taskPortMappings: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPortRules(t *testing.T) {
+	cases := []struct {
+		name   string
+		vmInfo VMInfo
+		want   [][]string
+	}{
+		{
+			name: "cni network on a host IP",
+			vmInfo: VMInfo{
+				NetworkMode:  networkModeCNI,
+				GuestIP:      "172.26.64.2",
+				PortMappings: []portMapping{{Label: "http", HostIP: "10.0.0.5", HostPort: 25000, GuestPort: 80}},
+			},
+			want: [][]string{
+				{"PREROUTING", "-d", "10.0.0.5/32", "-p", "tcp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:80"},
+				{"OUTPUT", "-d", "10.0.0.5/32", "-p", "tcp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:80"},
+				{"PREROUTING", "-d", "10.0.0.5/32", "-p", "udp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:80"},
+				{"OUTPUT", "-d", "10.0.0.5/32", "-p", "udp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:80"},
+			},
+		},
+		{
+			name: "cni network on every host address",
+			vmInfo: VMInfo{
+				NetworkMode:  networkModeCNI,
+				GuestIP:      "172.26.64.2",
+				PortMappings: []portMapping{{Label: "http", HostIP: "0.0.0.0", HostPort: 25000, GuestPort: 25000}},
+			},
+			want: [][]string{
+				{"PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-p", "tcp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:25000"},
+				{"OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-p", "tcp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:25000"},
+				{"PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-p", "udp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:25000"},
+				{"OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-p", "udp", "--dport", "25000", "-j", "DNAT", "--to-destination", "172.26.64.2:25000"},
+			},
+		},
+		{
+			name: "group network",
+			vmInfo: VMInfo{
+				NetworkMode:  networkModeGroup,
+				GuestIP:      "169.254.100.2",
+				TapName:      "tap0",
+				PortMappings: []portMapping{{Label: "http", HostIP: "10.0.0.5", HostPort: 25000, GuestPort: 80}},
+			},
+			want: [][]string{
+				{"PREROUTING", "!", "-i", "tap0", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "169.254.100.2:80"},
+				{"OUTPUT", "-d", "127.0.0.1/32", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "169.254.100.2:80"},
+				{"PREROUTING", "!", "-i", "tap0", "-p", "udp", "--dport", "80", "-j", "DNAT", "--to-destination", "169.254.100.2:80"},
+				{"OUTPUT", "-d", "127.0.0.1/32", "-p", "udp", "--dport", "80", "-j", "DNAT", "--to-destination", "169.254.100.2:80"},
+				{"POSTROUTING", "-s", "127.0.0.0/8", "-o", "tap0", "-j", "MASQUERADE"},
+			},
+		},
+		{
+			name: "group network without ports",
+			vmInfo: VMInfo{
+				NetworkMode: networkModeGroup,
+				GuestIP:     "169.254.100.2",
+				TapName:     "tap0",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := portRules(&tc.vmInfo)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got\n%q\nwant\n%q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+package litegix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// defaultRegistry is used for image references without a registry host
+	defaultRegistry = "docker.io"
+
+	// dockerHubRegistry is the API endpoint backing docker.io
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// Docker schema2 media types, still served by most registries
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// maxManifestSize bounds how much of a manifest response we will read
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+// manifestAcceptTypes lists every manifest flavour the client understands,
+// sent in the Accept header so registries don't downgrade to schema1
+var manifestAcceptTypes = []string{
+	ocispec.MediaTypeImageIndex,
+	ocispec.MediaTypeImageManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+}
+
+// imageReference is a parsed image name such as "busybox:latest" or
+// "ghcr.io/org/app@sha256:..."
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+// parseImageReference splits an image name into its registry, repository,
+// tag and digest, applying Docker's defaults for short names
+func parseImageReference(image string) (*imageReference, error) {
+	if image == "" {
+		return nil, fmt.Errorf("image reference is empty")
+	}
+
+	ref := &imageReference{}
+	name := image
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		d, err := digest.Parse(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest in image reference %q: %w", image, err)
+		}
+		ref.Digest = d
+		name = name[:i]
+	}
+
+	// A colon after the last slash separates the tag, anything before that
+	// belongs to a registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	// The first path component is a registry host only if it looks like one
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			name = name[i+1:]
+		}
+	}
+	if ref.Registry == "" {
+		ref.Registry = defaultRegistry
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" || strings.ToLower(name) != name {
+		return nil, fmt.Errorf("invalid repository name in image reference %q", image)
+	}
+	ref.Repository = name
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// String returns the fully qualified form of the reference
+func (r *imageReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// reference returns the tag or digest used in manifest requests, preferring
+// the digest when both are set
+func (r *imageReference) reference() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// registryClient pulls images over the OCI distribution API without relying
+// on a local container engine
+type registryClient struct {
+	client *http.Client
+	logger hclog.Logger
+
+	// platform selects the manifest to use from multi-arch indexes
+	platform ocispec.Platform
+
+	// tokens caches bearer tokens per registry and repository
+	tokensLock sync.Mutex
+	tokens     map[string]string
+}
+
+// newRegistryClient returns a registryClient using the given HTTP client, or
+// a default one when client is nil
+func newRegistryClient(client *http.Client, logger hclog.Logger) *registryClient {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Minute}
+	}
+	return &registryClient{
+		client: client,
+		logger: logger.Named("registry"),
+		platform: ocispec.Platform{
+			OS:           "linux",
+			Architecture: runtime.GOARCH,
+		},
+		tokens: map[string]string{},
+	}
+}
+
+// pulledImage describes an image written to a local image layout
+type pulledImage struct {
+	// ManifestDigest is the digest of the platform specific manifest
+	ManifestDigest digest.Digest
+	Manifest       ocispec.Manifest
+}
+
+// Resolve fetches the platform specific manifest for ref, following
+// manifest lists and OCI indexes
+func (c *registryClient) Resolve(ctx context.Context, ref *imageReference) (digest.Digest, *ocispec.Manifest, []byte, error) {
+	data, mediaType, dgst, err := c.fetchManifest(ctx, ref, ref.reference())
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if mediaType == ocispec.MediaTypeImageIndex || mediaType == mediaTypeDockerManifestList {
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return "", nil, nil, fmt.Errorf("failed to parse image index: %w", err)
+		}
+		desc, err := c.selectPlatform(index.Manifests)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("image %s: %w", ref, err)
+		}
+		data, mediaType, dgst, err = c.fetchManifest(ctx, ref, desc.Digest.String())
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	if mediaType != ocispec.MediaTypeImageManifest && mediaType != mediaTypeDockerManifest {
+		return "", nil, nil, fmt.Errorf("unsupported manifest media type %q", mediaType)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", nil, nil, fmt.Errorf("failed to parse image manifest: %w", err)
+	}
+	return dgst, &manifest, data, nil
+}
+
+// Pull resolves image and writes its manifest, config and layers into
+// targetDir. The layout is an OCI image layout with an additional
+// docker-save style manifest.json so createRootfs can consume it.
+func (c *registryClient) Pull(ctx context.Context, image, targetDir string) (*pulledImage, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	dgst, manifest, manifestData, err := c.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve image %s: %w", ref, err)
+	}
+	return c.Fetch(ctx, ref, dgst, manifest, manifestData, targetDir)
+}
+
+// Fetch downloads the blobs of an already resolved manifest into targetDir
+// and writes the image layout files describing it
+func (c *registryClient) Fetch(ctx context.Context, ref *imageReference, dgst digest.Digest, manifest *ocispec.Manifest, manifestData []byte, targetDir string) (*pulledImage, error) {
+	logger := c.logger.With("image", ref.String(), "digest", dgst)
+	logger.Info("fetching image", "layer_count", len(manifest.Layers))
+
+	blobDir := filepath.Join(targetDir, ocispec.ImageBlobsDir, string(dgst.Algorithm()))
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	if err := writeFileAtomic(blobPath(targetDir, dgst), manifestData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	blobs := append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, desc := range blobs {
+		if err := c.fetchBlob(ctx, ref, desc, blobPath(targetDir, desc.Digest)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeImageLayout(targetDir, ref, dgst, int64(len(manifestData)), manifest); err != nil {
+		return nil, err
+	}
+
+	logger.Info("pulled image")
+	return &pulledImage{ManifestDigest: dgst, Manifest: *manifest}, nil
+}
+
+// selectPlatform picks the manifest matching the client platform
+func (c *registryClient) selectPlatform(manifests []ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	for i, desc := range manifests {
+		p := desc.Platform
+		if p == nil {
+			continue
+		}
+		if p.OS != c.platform.OS || p.Architecture != c.platform.Architecture {
+			continue
+		}
+		// arm64 images are occasionally published with an explicit v8 variant
+		if c.platform.Variant != "" && p.Variant != "" && p.Variant != c.platform.Variant {
+			continue
+		}
+		return &manifests[i], nil
+	}
+	return nil, fmt.Errorf("no manifest for platform %s/%s", c.platform.OS, c.platform.Architecture)
+}
+
+// fetchManifest downloads a manifest by tag or digest. Manifests requested
+// by digest are verified against it.
+func (c *registryClient) fetchManifest(ctx context.Context, ref *imageReference, reference string) ([]byte, string, digest.Digest, error) {
+	u := c.url(ref, "manifests", reference)
+	resp, err := c.do(ctx, ref, http.MethodGet, u, strings.Join(manifestAcceptTypes, ", "))
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	// Read one byte past the limit to tell a full manifest from a cut one
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+
+	mediaType := manifestMediaType(resp.Header.Get("Content-Type"), data)
+	dgst := digest.FromBytes(data)
+	if expected, err := digest.Parse(reference); err == nil && expected != dgst {
+		return nil, "", "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", expected, dgst)
+	}
+	return data, mediaType, dgst, nil
+}
+
+// fetchBlob downloads a blob to path, verifying its size and digest. Blobs
+// already present in the layout are left untouched.
+func (c *registryClient) fetchBlob(ctx context.Context, ref *imageReference, desc ocispec.Descriptor, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid blob digest %q: %w", desc.Digest, err)
+	}
+
+	c.logger.Debug("downloading blob", "digest", desc.Digest, "size", desc.Size)
+	resp, err := c.do(ctx, ref, http.MethodGet, c.url(ref, "blobs", desc.Digest.String()), "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(tmp, verifier), resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download blob %s: %w", desc.Digest, err)
+	}
+	if desc.Size > 0 && n != desc.Size {
+		return fmt.Errorf("blob %s size mismatch: expected %d, got %d", desc.Digest, desc.Size, n)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %s failed digest verification", desc.Digest)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", desc.Digest, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// url builds a distribution API URL for the given repository resource
+func (c *registryClient) url(ref *imageReference, kind, reference string) string {
+	host := ref.Registry
+	if host == defaultRegistry {
+		host = dockerHubRegistry
+	}
+	u := url.URL{
+		Scheme: registryScheme(host),
+		Host:   host,
+		Path:   fmt.Sprintf("/v2/%s/%s/%s", ref.Repository, kind, reference),
+	}
+	return u.String()
+}
+
+// registryScheme returns the scheme used to talk to host. Like Docker,
+// registries on the loopback interface are reached over plain HTTP.
+func registryScheme(host string) string {
+	h := host
+	if sh, _, err := net.SplitHostPort(host); err == nil {
+		h = sh
+	}
+	if h == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(h); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// do performs an authenticated request, answering a bearer token challenge
+// once if the registry asks for one
+func (c *registryClient) do(ctx context.Context, ref *imageReference, method, u, accept string) (*http.Response, error) {
+	tokenKey := ref.Registry + "/" + ref.Repository
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		c.tokensLock.Lock()
+		token := c.tokens[tokenKey]
+		c.tokensLock.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("request to %s failed: %w", u, err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			token, err := c.fetchToken(ctx, challenge, ref.Repository)
+			if err != nil {
+				return nil, fmt.Errorf("failed to authenticate to %s: %w", ref.Registry, err)
+			}
+			c.tokensLock.Lock()
+			c.tokens[tokenKey] = token
+			c.tokensLock.Unlock()
+		default:
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s from %s: %s", resp.Status, u, strings.TrimSpace(string(body)))
+		}
+	}
+}
+
+// fetchToken requests an anonymous pull token from the realm named in a
+// Bearer WWW-Authenticate challenge
+func (c *registryClient) fetchToken(ctx context.Context, challenge, repository string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") {
+		return "", fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("auth challenge has no realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid auth realm %q: %w", realm, err)
+	}
+	q := u.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	if tr.AccessToken != "" {
+		return tr.AccessToken, nil
+	}
+	return "", fmt.Errorf("token response contained no token")
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header into its scheme and
+// parameters
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	scheme, rest, _ := strings.Cut(header, " ")
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, r, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(v)
+			rest = r
+		}
+	}
+	return scheme, params
+}
+
+// blobPath returns the location of a blob inside an image layout
+func blobPath(layoutDir string, dgst digest.Digest) string {
+	return filepath.Join(layoutDir, ocispec.ImageBlobsDir, string(dgst.Algorithm()), dgst.Encoded())
+}
+
+// writeImageLayout writes the oci-layout, index.json and docker-save style
+// manifest.json files describing a pulled image
+func writeImageLayout(dir string, ref *imageReference, dgst digest.Digest, size int64, manifest *ocispec.Manifest) error {
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ocispec.ImageLayoutFile), layout, 0644); err != nil {
+		return fmt.Errorf("failed to write image layout: %w", err)
+	}
+
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    dgst,
+			Size:      size,
+			Annotations: map[string]string{
+				ocispec.AnnotationRefName: ref.String(),
+			},
+		}},
+	}
+	index.SchemaVersion = 2
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ocispec.ImageIndexFile), indexData, 0644); err != nil {
+		return fmt.Errorf("failed to write image index: %w", err)
+	}
+
+	relBlob := func(d digest.Digest) string {
+		return filepath.ToSlash(filepath.Join(ocispec.ImageBlobsDir, string(d.Algorithm()), d.Encoded()))
+	}
+	dockerManifest := []struct {
+		Config   string   `json:"Config"`
+		RepoTags []string `json:"RepoTags"`
+		Layers   []string `json:"Layers"`
+	}{{
+		Config:   relBlob(manifest.Config.Digest),
+		RepoTags: []string{ref.String()},
+	}}
+	for _, layer := range manifest.Layers {
+		dockerManifest[0].Layers = append(dockerManifest[0].Layers, relBlob(layer.Digest))
+	}
+	manifestData, err := json.Marshal(dockerManifest)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "manifest.json"), manifestData, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest.json: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+// so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// manifestMediaType returns the media type of a manifest served with
+// contentType. Some registries and proxies send no Content-Type or a
+// generic one, so the document's own mediaType field is used instead, and
+// failing that its shape: an index lists manifests, an image has layers.
+func manifestMediaType(contentType string, data []byte) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	switch mediaType {
+	case "", "application/json", "application/octet-stream", "text/plain":
+	default:
+		return mediaType
+	}
+
+	var probe struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+		Layers    []json.RawMessage `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return mediaType
+	}
+	switch {
+	case probe.MediaType != "":
+		return probe.MediaType
+	case probe.Manifests != nil:
+		return ocispec.MediaTypeImageIndex
+	case probe.Layers != nil:
+		return ocispec.MediaTypeImageManifest
+	}
+	return mediaType
+}
@@ -0,0 +1,415 @@
+package litegix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry serves a single repository over the distribution API and
+// requires a bearer token from its own token endpoint
+type testRegistry struct {
+	t      *testing.T
+	server *httptest.Server
+	token  string
+
+	// manifests are served by tag or digest with their media type, blobs by
+	// digest
+	manifests map[string]testManifest
+	blobs     map[digest.Digest][]byte
+
+	tokenRequests int
+}
+
+type testManifest struct {
+	mediaType string
+	data      []byte
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		t:         t,
+		token:     "secret-token",
+		manifests: map[string]testManifest{},
+		blobs:     map[digest.Digest][]byte{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.tokenRequests++
+		if scope := req.URL.Query().Get("scope"); scope != "repository:test/app:pull" {
+			http.Error(w, "bad scope "+scope, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	kind, reference, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/test/app/"), "/")
+	switch {
+	case ok && kind == "manifests":
+		m, found := r.manifests[reference]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.data)
+	case ok && kind == "blobs":
+		blob, found := r.blobs[digest.Digest(reference)]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(blob)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// ref returns a reference to the registry's repository
+func (r *testRegistry) ref(reference string) *imageReference {
+	ref, err := parseImageReference(strings.TrimPrefix(r.server.URL, "http://") + "/test/app" + reference)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return ref
+}
+
+// addBlob stores data and returns its descriptor
+func (r *testRegistry) addBlob(mediaType string, data []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(data)
+	r.blobs[dgst] = data
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// addManifest stores v under its digest and the given tags and returns its
+// descriptor
+func (r *testRegistry) addManifest(mediaType string, v interface{}, tags ...string) ocispec.Descriptor {
+	data, err := json.Marshal(v)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	dgst := digest.FromBytes(data)
+	m := testManifest{mediaType: mediaType, data: data}
+	r.manifests[dgst.String()] = m
+	for _, tag := range tags {
+		r.manifests[tag] = m
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// addImage stores an image of one layer and returns its manifest
+// descriptor
+func (r *testRegistry) addImage(layer []byte, tags ...string) (ocispec.Descriptor, ocispec.Manifest) {
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+		Layers:    []ocispec.Descriptor{r.addBlob(ocispec.MediaTypeImageLayerGzip, layer)},
+	}
+	manifest.SchemaVersion = 2
+	return r.addManifest(ocispec.MediaTypeImageManifest, manifest, tags...), manifest
+}
+
+func newTestRegistryClient() *registryClient {
+	c := newRegistryClient(nil, hclog.NewNullLogger())
+	c.platform = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	return c
+}
+
+func TestRegistryClient_ResolveBearerToken(t *testing.T) {
+	r := newTestRegistry(t)
+	desc, _ := r.addImage([]byte("layer"), "v1")
+
+	c := newTestRegistryClient()
+	dgst, manifest, _, err := c.Resolve(context.Background(), r.ref(":v1"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if dgst != desc.Digest {
+		t.Errorf("digest = %s, want %s", dgst, desc.Digest)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Errorf("got %d layers, want 1", len(manifest.Layers))
+	}
+
+	// The token is reused for later requests to the repository
+	if _, _, _, err := c.Resolve(context.Background(), r.ref(":v1")); err != nil {
+		t.Fatalf("second Resolve: %v", err)
+	}
+	if r.tokenRequests != 1 {
+		t.Errorf("token requested %d times, want 1", r.tokenRequests)
+	}
+}
+
+func TestRegistryClient_ResolveManifestList(t *testing.T) {
+	r := newTestRegistry(t)
+	armDesc, _ := r.addImage([]byte("arm layer"))
+	amdDesc, _ := r.addImage([]byte("amd layer"))
+	armDesc.Platform = &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	amdDesc.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+	index := ocispec.Index{
+		MediaType: mediaTypeDockerManifestList,
+		Manifests: []ocispec.Descriptor{armDesc, amdDesc},
+	}
+	index.SchemaVersion = 2
+	r.addManifest(mediaTypeDockerManifestList, index, "multi")
+
+	c := newTestRegistryClient()
+	dgst, _, _, err := c.Resolve(context.Background(), r.ref(":multi"))
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if dgst != amdDesc.Digest {
+		t.Errorf("digest = %s, want the amd64 manifest %s", dgst, amdDesc.Digest)
+	}
+
+	c.platform = ocispec.Platform{OS: "linux", Architecture: "riscv64"}
+	if _, _, _, err := c.Resolve(context.Background(), r.ref(":multi")); err == nil {
+		t.Error("Resolve succeeded without a manifest for the platform")
+	}
+}
+
+func TestRegistryClient_ResolveGenericContentType(t *testing.T) {
+	for _, contentType := range []string{"", "application/json", "application/json; charset=utf-8"} {
+		t.Run(contentType, func(t *testing.T) {
+			r := newTestRegistry(t)
+			_, manifest := r.addImage([]byte("layer"))
+
+			// Neither document carries a mediaType field, so only their
+			// shape tells an index from an image
+			manifest.MediaType = ""
+			desc := r.addManifest(contentType, manifest)
+			desc.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+			index := ocispec.Index{Manifests: []ocispec.Descriptor{desc}}
+			index.SchemaVersion = 2
+			r.addManifest(contentType, index, "multi")
+
+			c := newTestRegistryClient()
+			dgst, got, _, err := c.Resolve(context.Background(), r.ref(":multi"))
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if dgst != desc.Digest {
+				t.Errorf("digest = %s, want %s", dgst, desc.Digest)
+			}
+			if len(got.Layers) != 1 {
+				t.Errorf("got %d layers, want 1", len(got.Layers))
+			}
+		})
+	}
+}
+
+func TestManifestMediaType(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		data        string
+		want        string
+	}{
+		{
+			name:        "content type wins",
+			contentType: mediaTypeDockerManifest,
+			data:        `{"mediaType":"` + ocispec.MediaTypeImageManifest + `"}`,
+			want:        mediaTypeDockerManifest,
+		},
+		{
+			name:        "parameters are dropped",
+			contentType: ocispec.MediaTypeImageIndex + "; charset=utf-8",
+			want:        ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:        "mediaType field",
+			contentType: "application/json",
+			data:        `{"mediaType":"` + mediaTypeDockerManifestList + `","manifests":[]}`,
+			want:        mediaTypeDockerManifestList,
+		},
+		{
+			name: "index shape",
+			data: `{"schemaVersion":2,"manifests":[]}`,
+			want: ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:        "image shape",
+			contentType: "application/octet-stream",
+			data:        `{"schemaVersion":2,"config":{},"layers":[]}`,
+			want:        ocispec.MediaTypeImageManifest,
+		},
+		{
+			name:        "unknown document",
+			contentType: "application/json",
+			data:        `{"schemaVersion":1}`,
+			want:        "application/json",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := manifestMediaType(tc.contentType, []byte(tc.data)); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegistryClient_ResolveDigestMismatch(t *testing.T) {
+	r := newTestRegistry(t)
+	desc, _ := r.addImage([]byte("layer"))
+	other, _ := r.addImage([]byte("other layer"))
+	r.manifests[desc.Digest.String()] = r.manifests[other.Digest.String()]
+
+	c := newTestRegistryClient()
+	_, _, _, err := c.Resolve(context.Background(), r.ref("@"+desc.Digest.String()))
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("Resolve error = %v, want a digest mismatch", err)
+	}
+}
+
+func TestRegistryClient_ResolveManifestTooLarge(t *testing.T) {
+	r := newTestRegistry(t)
+	r.addImage([]byte("layer"), "v1")
+	manifest := r.manifests["v1"]
+	c := newTestRegistryClient()
+
+	// Trailing whitespace keeps the padded manifest valid JSON
+	pad := func(size int) {
+		m := manifest
+		m.data = append(append([]byte{}, manifest.data...), bytes.Repeat([]byte(" "), size-len(manifest.data))...)
+		r.manifests["v1"] = m
+	}
+
+	pad(maxManifestSize)
+	if _, _, _, err := c.Resolve(context.Background(), r.ref(":v1")); err != nil {
+		t.Errorf("Resolve of a manifest at the limit: %v", err)
+	}
+
+	pad(maxManifestSize + 1)
+	_, _, _, err := c.Resolve(context.Background(), r.ref(":v1"))
+	if err == nil || !strings.Contains(err.Error(), "manifest exceeds") {
+		t.Fatalf("Resolve error = %v, want the manifest size limit", err)
+	}
+}
+
+func TestRegistryClient_Pull(t *testing.T) {
+	r := newTestRegistry(t)
+	desc, manifest := r.addImage([]byte("layer"), "v1")
+
+	dir := t.TempDir()
+	c := newTestRegistryClient()
+	pulled, err := c.Pull(context.Background(), r.ref(":v1").String(), dir)
+	if err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if pulled.ManifestDigest != desc.Digest {
+		t.Errorf("digest = %s, want %s", pulled.ManifestDigest, desc.Digest)
+	}
+	for _, d := range []ocispec.Descriptor{desc, manifest.Config, manifest.Layers[0]} {
+		if _, err := os.Stat(blobPath(dir, d.Digest)); err != nil {
+			t.Errorf("blob %s missing from layout: %v", d.Digest, err)
+		}
+	}
+	for _, name := range []string{ocispec.ImageLayoutFile, ocispec.ImageIndexFile, "manifest.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s missing from layout: %v", name, err)
+		}
+	}
+}
+
+func TestRegistryClient_FetchBlobMismatch(t *testing.T) {
+	cases := []struct {
+		name string
+		// corrupt changes the descriptor or the served blob
+		corrupt func(r *testRegistry, desc *ocispec.Descriptor)
+		want    string
+	}{
+		{
+			name: "size",
+			corrupt: func(r *testRegistry, desc *ocispec.Descriptor) {
+				desc.Size++
+			},
+			want: "size mismatch",
+		},
+		{
+			name: "digest",
+			corrupt: func(r *testRegistry, desc *ocispec.Descriptor) {
+				r.blobs[desc.Digest] = []byte("tampered")
+				desc.Size = int64(len("tampered"))
+			},
+			want: "digest verification",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			desc := r.addBlob(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+			tc.corrupt(r, &desc)
+
+			path := filepath.Join(t.TempDir(), "blob")
+			c := newTestRegistryClient()
+			err := c.fetchBlob(context.Background(), r.ref(":v1"), desc, path)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("fetchBlob error = %v, want %q", err, tc.want)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("rejected blob was stored")
+			}
+		})
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	const dgst = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	cases := []struct {
+		image string
+		want  imageReference
+	}{
+		{"busybox", imageReference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"busybox:1.36", imageReference{Registry: "docker.io", Repository: "library/busybox", Tag: "1.36"}},
+		{"org/app", imageReference{Registry: "docker.io", Repository: "org/app", Tag: "latest"}},
+		{"ghcr.io/org/app:v1", imageReference{Registry: "ghcr.io", Repository: "org/app", Tag: "v1"}},
+		{"localhost/app", imageReference{Registry: "localhost", Repository: "app", Tag: "latest"}},
+		{"localhost:5000/app:v2", imageReference{Registry: "localhost:5000", Repository: "app", Tag: "v2"}},
+		{"app@" + dgst, imageReference{Registry: "docker.io", Repository: "library/app", Digest: dgst}},
+		{"app:v1@" + dgst, imageReference{Registry: "docker.io", Repository: "library/app", Tag: "v1", Digest: dgst}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.image, func(t *testing.T) {
+			ref, err := parseImageReference(tc.image)
+			if err != nil {
+				t.Fatalf("parseImageReference: %v", err)
+			}
+			if *ref != tc.want {
+				t.Errorf("got %+v, want %+v", *ref, tc.want)
+			}
+		})
+	}
+
+	for _, image := range []string{"", "App", "app@sha256:short"} {
+		if _, err := parseImageReference(image); err == nil {
+			t.Errorf("parseImageReference(%q) succeeded", image)
+		}
+	}
+}
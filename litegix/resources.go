@@ -0,0 +1,70 @@
+package litegix
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// maxVCPUs is the largest vCPU count firecracker supports
+const maxVCPUs = 32
+
+// vmSize is the machine configuration of a task's VM
+type vmSize struct {
+	VCPUs  int
+	MemMiB int
+}
+
+// sizeVM derives a VM's vCPUs and memory from the resources Nomad scheduled
+// for the task. Reserved cores map to one vCPU each, and cpu MHz are
+// converted with the configured ratio, rounding up. The guest gets the
+// task's memory_max, or memory when unset, minus the VMM overhead. The
+// task's vpu_count and mem_size override the derived values but must fit
+// inside the reservation.
+func sizeVM(resources *drivers.Resources, config *TaskConfig, driverConfig *Config) (*vmSize, error) {
+	if resources == nil || resources.NomadResources == nil {
+		// Without a reservation only explicit sizes can be used
+		if config.VpuCount <= 0 || config.MemSize <= 0 {
+			return nil, fmt.Errorf("task has no resources, vpu_count and mem_size must be set")
+		}
+		return &vmSize{VCPUs: config.VpuCount, MemMiB: config.MemSize}, nil
+	}
+
+	cpu := resources.NomadResources.Cpu
+	vcpus := len(cpu.ReservedCores)
+	if vcpus == 0 {
+		mhzPerVCPU := int64(driverConfig.CPUMHzPerVCPU)
+		vcpus = int((cpu.CpuShares + mhzPerVCPU - 1) / mhzPerVCPU)
+	}
+	if vcpus < 1 {
+		vcpus = 1
+	}
+	if vcpus > maxVCPUs {
+		vcpus = maxVCPUs
+	}
+
+	memory := resources.NomadResources.Memory
+	memMiB := int(memory.MemoryMB)
+	if memory.MemoryMaxMB > memory.MemoryMB {
+		memMiB = int(memory.MemoryMaxMB)
+	}
+	memMiB -= driverConfig.VMMMemoryOverhead
+	if memMiB <= 0 {
+		return nil, fmt.Errorf("memory reservation of %d MB does not cover the VMM overhead of %d MB", memory.MemoryMB, driverConfig.VMMMemoryOverhead)
+	}
+
+	size := &vmSize{VCPUs: vcpus, MemMiB: memMiB}
+	if config.VpuCount != 0 {
+		if config.VpuCount < 0 || config.VpuCount > vcpus {
+			return nil, fmt.Errorf("vpu_count %d must be between 1 and the %d vCPUs the task's cpu reservation allows", config.VpuCount, vcpus)
+		}
+		size.VCPUs = config.VpuCount
+	}
+	if config.MemSize != 0 {
+		if config.MemSize < 0 || config.MemSize > memMiB {
+			return nil, fmt.Errorf("mem_size %d must be between 1 and the %d MB the task's memory reservation allows", config.MemSize, memMiB)
+		}
+		size.MemMiB = config.MemSize
+	}
+	return size, nil
+}
@@ -0,0 +1,131 @@
+package litegix
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// testResources returns the resources of a task reserving cpu MHz, cores
+// and memory
+func testResources(cpu int64, cores []uint16, memoryMB, memoryMaxMB int64) *drivers.Resources {
+	return &drivers.Resources{
+		NomadResources: &structs.AllocatedTaskResources{
+			Cpu: structs.AllocatedCpuResources{
+				CpuShares:     cpu,
+				ReservedCores: cores,
+			},
+			Memory: structs.AllocatedMemoryResources{
+				MemoryMB:    memoryMB,
+				MemoryMaxMB: memoryMaxMB,
+			},
+		},
+	}
+}
+
+func TestSizeVM(t *testing.T) {
+	driverConfig := &Config{CPUMHzPerVCPU: 1000, VMMMemoryOverhead: 16}
+
+	cases := []struct {
+		name      string
+		resources *drivers.Resources
+		config    TaskConfig
+		want      vmSize
+		wantErr   string
+	}{
+		{
+			name:      "cpu below one vCPU",
+			resources: testResources(100, nil, 256, 0),
+			want:      vmSize{VCPUs: 1, MemMiB: 240},
+		},
+		{
+			name:      "cpu is a whole number of vCPUs",
+			resources: testResources(2000, nil, 256, 0),
+			want:      vmSize{VCPUs: 2, MemMiB: 240},
+		},
+		{
+			name:      "cpu rounds up",
+			resources: testResources(2001, nil, 256, 0),
+			want:      vmSize{VCPUs: 3, MemMiB: 240},
+		},
+		{
+			name:      "vCPUs are capped",
+			resources: testResources(100000, nil, 256, 0),
+			want:      vmSize{VCPUs: maxVCPUs, MemMiB: 240},
+		},
+		{
+			name:      "reserved cores map to one vCPU each",
+			resources: testResources(7000, []uint16{2, 3}, 256, 0),
+			want:      vmSize{VCPUs: 2, MemMiB: 240},
+		},
+		{
+			name:      "memory_max is preferred over memory",
+			resources: testResources(1000, nil, 256, 1024),
+			want:      vmSize{VCPUs: 1, MemMiB: 1008},
+		},
+		{
+			name:      "memory_max below memory is ignored",
+			resources: testResources(1000, nil, 256, 128),
+			want:      vmSize{VCPUs: 1, MemMiB: 240},
+		},
+		{
+			name:      "memory does not cover the overhead",
+			resources: testResources(1000, nil, 16, 0),
+			wantErr:   "does not cover the VMM overhead",
+		},
+		{
+			name:      "overrides within the reservation",
+			resources: testResources(4000, nil, 1024, 0),
+			config:    TaskConfig{VpuCount: 2, MemSize: 512},
+			want:      vmSize{VCPUs: 2, MemMiB: 512},
+		},
+		{
+			name:      "vpu_count above the reservation",
+			resources: testResources(1000, nil, 1024, 0),
+			config:    TaskConfig{VpuCount: 2},
+			wantErr:   "vpu_count 2",
+		},
+		{
+			name:      "negative vpu_count",
+			resources: testResources(1000, nil, 1024, 0),
+			config:    TaskConfig{VpuCount: -1},
+			wantErr:   "vpu_count -1",
+		},
+		{
+			name:      "mem_size above the reservation minus overhead",
+			resources: testResources(1000, nil, 1024, 0),
+			config:    TaskConfig{MemSize: 1024},
+			wantErr:   "mem_size 1024",
+		},
+		{
+			name:    "no resources needs explicit sizes",
+			config:  TaskConfig{VpuCount: 2},
+			wantErr: "vpu_count and mem_size must be set",
+		},
+		{
+			name:   "no resources with explicit sizes",
+			config: TaskConfig{VpuCount: 2, MemSize: 512},
+			want:   vmSize{VCPUs: 2, MemMiB: 512},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			size, err := sizeVM(tc.resources, &tc.config, driverConfig)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sizeVM: %v", err)
+			}
+			if *size != tc.want {
+				t.Errorf("got %+v, want %+v", *size, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package litegix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/client/lib/cpustats"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// clockTicks is the kernel's USER_HZ, the unit of CPU times in /proc
+	clockTicks = 100
+
+	// balloonStatsInterval is how often, in seconds, the guest reports its
+	// memory statistics through the balloon device
+	balloonStatsInterval = 1
+
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+var (
+	// Names of the stats collected for every task
+	measuredCPUStats    = []string{"System Mode", "User Mode", "Percent", "Total Ticks"}
+	measuredMemoryStats = []string{"RSS", "Swap", "Usage", "Max Usage"}
+)
+
+// vmStatsCollector samples the resource usage of a task's VM. CPU usage
+// and memory footprint are taken from the host's accounting of the
+// firecracker process, using its cgroup when the VM has one of its own, and
+// the guest's view of its memory comes from the balloon device.
+type vmStatsCollector struct {
+	vmInfo *VMInfo
+
+	userCPU   *cpustats.Tracker
+	systemCPU *cpustats.Tracker
+	totalCPU  *cpustats.Tracker
+}
+
+func newVMStatsCollector(vmInfo *VMInfo, compute cpustats.Compute) *vmStatsCollector {
+	return &vmStatsCollector{
+		vmInfo:    vmInfo,
+		userCPU:   cpustats.New(compute),
+		systemCPU: cpustats.New(compute),
+		totalCPU:  cpustats.New(compute),
+	}
+}
+
+// Collect returns the VM's current resource usage
+func (c *vmStatsCollector) Collect(ctx context.Context) (*drivers.TaskResourceUsage, error) {
+	pid := int(c.vmInfo.PID)
+	if !vmmAlive(c.vmInfo) {
+		return nil, fmt.Errorf("firecracker process %d is not running", pid)
+	}
+
+	user, system, err := processCPUTimes(pid)
+	if err != nil {
+		return nil, err
+	}
+	status, err := processStatus(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	cpu := &drivers.CpuStats{
+		UserMode:   c.userCPU.Percent(float64(user.Nanoseconds())),
+		SystemMode: c.systemCPU.Percent(float64(system.Nanoseconds())),
+		Percent:    c.totalCPU.Percent(float64((user + system).Nanoseconds())),
+		Measured:   measuredCPUStats,
+	}
+	cpu.TotalTicks = c.totalCPU.TicksConsumed(cpu.Percent)
+
+	memory := &drivers.MemoryStats{
+		RSS:      status["VmRSS"],
+		Swap:     status["VmSwap"],
+		Usage:    status["VmRSS"],
+		MaxUsage: status["VmHWM"],
+		Measured: measuredMemoryStats,
+	}
+
+	if cgroup := vmCgroup(pid); cgroup != "" {
+		c.addCgroupStats(cgroup, cpu, memory)
+	}
+	c.addGuestStats(ctx, memory)
+
+	usage := &drivers.ResourceUsage{MemoryStats: memory, CpuStats: cpu}
+	return &drivers.TaskResourceUsage{
+		ResourceUsage: usage,
+		Timestamp:     time.Now().UTC().UnixNano(),
+		Pids:          map[string]*drivers.ResourceUsage{strconv.Itoa(pid): usage},
+	}, nil
+}
+
+// addCgroupStats replaces the process accounting with that of the VM's
+// cgroup, which also covers threads and helpers outside the main process,
+// and adds CPU throttling
+func (c *vmStatsCollector) addCgroupStats(cgroup string, cpu *drivers.CpuStats, memory *drivers.MemoryStats) {
+	if stat, err := readKeyValues(filepath.Join(cgroup, "cpu.stat")); err == nil {
+		cpu.ThrottledPeriods = stat["nr_throttled"]
+		cpu.ThrottledTime = stat["throttled_usec"] * uint64(time.Microsecond)
+		cpu.Measured = append(cpu.Measured, "Throttled Periods", "Throttled Time")
+	}
+	if current, err := readUint(filepath.Join(cgroup, "memory.current")); err == nil {
+		memory.Usage = current
+	}
+	if peak, err := readUint(filepath.Join(cgroup, "memory.peak")); err == nil {
+		memory.MaxUsage = peak
+	}
+}
+
+// addGuestStats adds the page cache the guest reports through the balloon
+// device. Guests without a balloon driver report nothing.
+func (c *vmStatsCollector) addGuestStats(ctx context.Context, memory *drivers.MemoryStats) {
+	if c.vmInfo.Machine == nil {
+		return
+	}
+	stats, err := c.vmInfo.Machine.GetBalloonStats(ctx)
+	if err != nil || stats.TotalMemory == 0 {
+		return
+	}
+	memory.Cache = uint64(stats.DiskCaches)
+	memory.Measured = append(memory.Measured, "Cache")
+}
+
+// processCPUTimes returns the user and system CPU time used by pid
+func processCPUTimes(pid int) (user, system time.Duration, err error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read process stats: %w", err)
+	}
+	// The command name may contain spaces, so fields are counted from the
+	// closing parenthesis after it, which is followed by field 3
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("failed to parse process stats")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("failed to parse process stats")
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	tick := time.Second / clockTicks
+	return time.Duration(utime) * tick, time.Duration(stime) * tick, nil
+}
+
+// processStatus returns the memory figures in /proc/<pid>/status in bytes
+func processStatus(pid int) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read process status: %w", err)
+	}
+	defer f.Close()
+
+	status := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || !strings.HasPrefix(key, "Vm") {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) != 2 || fields[1] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[0], 10, 64)
+		if err == nil {
+			status[key] = kb * 1024
+		}
+	}
+	return status, scanner.Err()
+}
+
+// vmCgroup returns the cgroup v2 directory of pid if it differs from the
+// plugin's own. A VM still sharing the plugin's cgroup is accounted by its
+// process instead.
+func vmCgroup(pid int) string {
+	own := unifiedCgroup("self")
+	cgroup := unifiedCgroup(strconv.Itoa(pid))
+	if cgroup == "" || cgroup == own {
+		return ""
+	}
+	return filepath.Join(cgroupRoot, cgroup)
+}
+
+// unifiedCgroup returns the cgroup v2 path of a /proc entry
+func unifiedCgroup(proc string) string {
+	data, err := os.ReadFile(filepath.Join("/proc", proc, "cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// readKeyValues parses a flat keyed cgroup file such as cpu.stat
+func readKeyValues(path string) (map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, nil
+}
+
+// readUint reads a single value cgroup file such as memory.current
+func readUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
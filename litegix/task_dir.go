@@ -0,0 +1,226 @@
+package litegix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shadm/nomad-litegix-fc-driver/litegix/vminit"
+)
+
+// taskDirSyncTimeout bounds a single pass copying changed files to a guest
+const taskDirSyncTimeout = time.Minute
+
+// taskDir is a Nomad task directory shared with the guest
+type taskDir struct {
+	// Name names the directory's drive and its image in the VM directory
+	Name      string
+	HostPath  string
+	GuestPath string
+
+	// Secret marks directories whose image only root may read on the host
+	Secret bool
+}
+
+// taskDirs returns the directories Nomad prepared for a task, which the
+// guest sees at the same paths as tasks of other drivers with image
+// isolation
+func taskDirs(cfg *drivers.TaskConfig) []taskDir {
+	dir := cfg.TaskDir()
+	return []taskDir{
+		{Name: "alloc", HostPath: dir.SharedAllocDir, GuestPath: allocdir.SharedAllocContainerPath},
+		{Name: "local", HostPath: dir.LocalDir, GuestPath: allocdir.TaskLocalContainerPath},
+		{Name: "secrets", HostPath: dir.SecretsDir, GuestPath: allocdir.TaskSecretsContainerPath, Secret: true},
+	}
+}
+
+// skipped reports whether rel, relative to the directory, stays on the
+// host. The alloc directory holds the task logs, which the guest writes
+// through its console rather than reads.
+func (d taskDir) skipped(rel string) bool {
+	return d.Name == "alloc" && rel == allocdir.LogDirName
+}
+
+// driveDevice returns the guest device of the drive attached at index,
+// counting the root drive as 0
+func driveDevice(index int) string {
+	return "/dev/vd" + string(rune('a'+index))
+}
+
+// buildTaskDirDrives snapshots the task directories into ext4 images in
+// vmDir and returns the drives attaching them, starting at device index
+// first, along with the mounts the guest init makes for them. Directories
+// missing on the host are left out.
+func buildTaskDirDrives(ctx context.Context, vmDir string, dirs []taskDir, first int) ([]models.Drive, []vminit.Mount, error) {
+	var drives []models.Drive
+	var mounts []vminit.Mount
+	for _, d := range dirs {
+		if _, err := os.Stat(d.HostPath); os.IsNotExist(err) {
+			continue
+		}
+
+		imagePath := filepath.Join(vmDir, d.Name+".ext4")
+		if err := buildTaskDirImage(ctx, d, imagePath); err != nil {
+			return nil, nil, fmt.Errorf("failed to build %s drive: %w", d.Name, err)
+		}
+
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String(d.Name),
+			PathOnHost:   firecracker.String(imagePath),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(false),
+		})
+		mounts = append(mounts, vminit.Mount{
+			Device: driveDevice(first + len(mounts)),
+			Path:   d.GuestPath,
+			FSType: "ext4",
+		})
+	}
+	return drives, mounts, nil
+}
+
+// buildTaskDirImage creates the ext4 image of a task directory
+func buildTaskDirImage(ctx context.Context, d taskDir, imagePath string) error {
+	source := d.HostPath
+	if d.Name == "alloc" {
+		// Copy everything but the skipped entries to a staging directory,
+		// as mkfs.ext4 takes whole directories only
+		staging, err := os.MkdirTemp(filepath.Dir(imagePath), d.Name+"-")
+		if err != nil {
+			return fmt.Errorf("failed to create staging dir: %w", err)
+		}
+		defer os.RemoveAll(staging)
+
+		entries, err := os.ReadDir(d.HostPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if d.skipped(e.Name()) {
+				continue
+			}
+			cmd := exec.CommandContext(ctx, "cp", "-a", "--reflink=auto", filepath.Join(d.HostPath, e.Name()), staging)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to copy %s: %w: %s", e.Name(), err, output)
+			}
+		}
+		source = staging
+	}
+
+	if _, err := buildExt4(ctx, source, imagePath, nil); err != nil {
+		return err
+	}
+	if d.Secret {
+		return os.Chmod(imagePath, 0600)
+	}
+	return nil
+}
+
+// fileStamp identifies a version of a file on the host
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	uid     int
+	gid     int
+}
+
+// taskDirSyncer copies files that change on the host after a VM started,
+// such as re-rendered templates, into the guest's task directories through
+// the VM agent. Changes made in the guest are not copied back.
+type taskDirSyncer struct {
+	lock   sync.Mutex
+	dirs   []taskDir
+	client *VMExecClient
+	logger hclog.Logger
+
+	// seen holds the files the guest is known to have, by host path
+	seen map[string]fileStamp
+}
+
+// newTaskDirSyncer creates a syncer for a guest that has the files
+// described by seen
+func newTaskDirSyncer(dirs []taskDir, seen map[string]fileStamp, client *VMExecClient, logger hclog.Logger) *taskDirSyncer {
+	return &taskDirSyncer{
+		dirs:   dirs,
+		client: client,
+		logger: logger.Named("task_dir_sync"),
+		seen:   seen,
+	}
+}
+
+// scanTaskDirs returns the regular files in the task directories
+func scanTaskDirs(dirs []taskDir) map[string]fileStamp {
+	files := map[string]fileStamp{}
+	for _, d := range dirs {
+		filepath.WalkDir(d.HostPath, func(p string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(d.HostPath, p)
+			if d.skipped(rel) {
+				return filepath.SkipDir
+			}
+			if !e.Type().IsRegular() {
+				return nil
+			}
+			info, err := e.Info()
+			if err != nil {
+				return nil
+			}
+			stamp := fileStamp{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				stamp.uid, stamp.gid = int(st.Uid), int(st.Gid)
+			}
+			files[p] = stamp
+			return nil
+		})
+	}
+	return files
+}
+
+// Sync copies the files that changed since the last sync to the guest.
+// Files that fail to copy are tried again on the next sync.
+func (s *taskDirSyncer) Sync(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var errs []error
+	for _, d := range s.dirs {
+		for p, stamp := range scanTaskDirs([]taskDir{d}) {
+			if s.seen[p] == stamp {
+				continue
+			}
+			rel, _ := filepath.Rel(d.HostPath, p)
+			guestPath := filepath.Join(d.GuestPath, rel)
+			if err := s.copyFile(ctx, p, guestPath, stamp); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			s.logger.Debug("copied file to guest", "path", guestPath)
+			s.seen[p] = stamp
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *taskDirSyncer) copyFile(ctx context.Context, hostPath, guestPath string, stamp fileStamp) error {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.client.WriteFile(ctx, guestPath, stamp.mode, stamp.uid, stamp.gid, f)
+}
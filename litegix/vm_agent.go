@@ -1,25 +1,24 @@
 package litegix
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"os/exec"
-	"strings"
+	"syscall"
 	"time"
 
+	fcvsock "github.com/firecracker-microvm/firecracker-go-sdk/vsock"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shadm/nomad-litegix-fc-driver/litegix/agent"
 )
 
-// ExecRequest represents a command execution request
-type ExecRequest struct {
-	Command []string          `json:"command"`
-	Env     map[string]string `json:"env,omitempty"`
-	WorkDir string            `json:"workdir,omitempty"`
-	Timeout int               `json:"timeout,omitempty"` // seconds
-}
+// guestCID is the vsock context ID assigned to every VM
+const guestCID = 3
 
 // ExecResponse represents the result of command execution
 type ExecResponse struct {
@@ -29,212 +28,244 @@ type ExecResponse struct {
 	Error    string `json:"error,omitempty"`
 }
 
-// VMAgent handles exec requests inside the VM
-type VMAgent struct {
-	logger   hclog.Logger
-	listener net.Listener
+// VM exec client implementation for the driver
+type VMExecClient struct {
+	vmInfo *VMInfo
+	logger hclog.Logger
 }
 
-// NewVMAgent creates a new VM agent
-func NewVMAgent(logger hclog.Logger) *VMAgent {
-	return &VMAgent{
-		logger: logger.Named("vm_agent"),
+// NewVMExecClient creates a new VM exec client
+func NewVMExecClient(vmInfo *VMInfo, logger hclog.Logger) *VMExecClient {
+	return &VMExecClient{
+		vmInfo: vmInfo,
+		logger: logger.Named("vm_exec_client"),
 	}
 }
 
-// Start starts the VM agent listening on vsock
-func (a *VMAgent) Start(ctx context.Context) error {
-	// Try to listen on vsock first, fallback to unix socket for testing
-	var err error
-	
-	// Firecracker vsock address - CID 2 is host, port 1024 for exec
-	a.listener, err = net.Listen("tcp", "127.0.0.1:1024")
+// ExecuteCommand executes a command in the VM and collects its output
+func (c *VMExecClient) ExecuteCommand(ctx context.Context, command []string, timeout time.Duration) (*ExecResponse, error) {
+	c.logger.Info("executing command in VM", "command", command, "vm_id", c.vmInfo.VMID)
+
+	// Connect to the VM agent
+	conn, err := c.dial(ctx)
 	if err != nil {
-		a.logger.Error("failed to listen on TCP socket", "error", err)
-		return fmt.Errorf("failed to listen: %w", err)
+		return nil, fmt.Errorf("failed to connect to VM agent: %w", err)
 	}
+	defer conn.Close()
 
-	a.logger.Info("VM agent started", "address", a.listener.Addr())
+	var stdout, stderr bytes.Buffer
+	req := &agent.ExecRequest{
+		Command: command,
+		Timeout: int(timeout.Seconds()),
+	}
+	exit, err := c.runSession(ctx, conn, req, nil, &stdout, &stderr, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	go a.handleConnections(ctx)
-	return nil
+	return &ExecResponse{
+		ExitCode: exit.ExitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Error:    exit.Error,
+	}, nil
 }
 
-// handleConnections handles incoming exec requests
-func (a *VMAgent) handleConnections(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			conn, err := a.listener.Accept()
-			if err != nil {
-				a.logger.Error("failed to accept connection", "error", err)
-				continue
-			}
+// ExecStreaming runs a command in the VM, streaming its input and output
+// and optionally attaching it to a pseudo-terminal
+func (c *VMExecClient) ExecStreaming(ctx context.Context, opts *drivers.ExecOptions) (*drivers.ExitResult, error) {
+	c.logger.Info("starting exec session in VM", "command", opts.Command, "tty", opts.Tty, "vm_id", c.vmInfo.VMID)
 
-			go a.handleConnection(conn)
-		}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to VM agent: %w", err)
 	}
-}
-
-// handleConnection handles a single exec request
-func (a *VMAgent) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	// Set connection timeout
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
-
-	// Read request
-	decoder := json.NewDecoder(conn)
-	var req ExecRequest
-	if err := decoder.Decode(&req); err != nil {
-		a.logger.Error("failed to decode request", "error", err)
-		return
+	req := &agent.ExecRequest{
+		Command: opts.Command,
+		Tty:     opts.Tty,
 	}
-
-	a.logger.Info("executing command", "command", req.Command)
-
-	// Execute command
-	response := a.executeCommand(&req)
-
-	// Send response
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(response); err != nil {
-		a.logger.Error("failed to encode response", "error", err)
+	exit, err := c.runSession(ctx, conn, req, opts.Stdin, opts.Stdout, opts.Stderr, opts.ResizeCh)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// executeCommand executes the command and returns the response
-func (a *VMAgent) executeCommand(req *ExecRequest) *ExecResponse {
-	if len(req.Command) == 0 {
-		return &ExecResponse{
-			ExitCode: 1,
-			Error:    "no command specified",
-		}
+	if exit.Error != "" {
+		return nil, fmt.Errorf("failed to execute command: %s", exit.Error)
 	}
+	return &drivers.ExitResult{
+		ExitCode: exit.ExitCode,
+		Signal:   exit.Signal,
+	}, nil
+}
 
-	// Set timeout (default 30 seconds)
-	timeout := 30
-	if req.Timeout > 0 {
-		timeout = req.Timeout
+// WriteFile writes the contents of r to path in the guest, replacing any
+// file there
+func (c *VMExecClient) WriteFile(ctx context.Context, path string, mode os.FileMode, uid, gid int, r io.Reader) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to VM agent: %w", err)
 	}
+	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	defer cancel()
-
-	// Create command
-	cmd := exec.CommandContext(ctx, req.Command[0], req.Command[1:]...)
+	// Closing the connection unblocks the writes and reads below when ctx
+	// ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
 
-	// Set working directory
-	if req.WorkDir != "" {
-		cmd.Dir = req.WorkDir
+	out := agent.NewFrameWriter(conn)
+	req := &agent.WriteFileRequest{Path: path, Mode: uint32(mode.Perm()), UID: uid, GID: gid}
+	if err := out.WriteJSON(agent.FrameWriteFile, req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
 	}
-
-	// Set environment variables
-	cmd.Env = os.Environ()
-	for key, value := range req.Env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	buf := make([]byte, 256*1024)
+	if _, err := io.CopyBuffer(out.StreamWriter(agent.FrameStdin), r, buf); err != nil {
+		return fmt.Errorf("failed to send file contents: %w", err)
 	}
-
-	// Capture output
-	var stdout, stderr strings.Builder
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	// Execute
-	err := cmd.Run()
-	
-	response := &ExecResponse{
-		Stdout: stdout.String(),
-		Stderr: stderr.String(),
+	if err := out.WriteFrame(agent.FrameStdin, nil); err != nil {
+		return fmt.Errorf("failed to send file contents: %w", err)
 	}
 
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			response.ExitCode = exitError.ExitCode()
-		} else {
-			response.ExitCode = 1
-			response.Error = err.Error()
+	for {
+		typ, payload, err := agent.ReadFrame(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+		if typ != agent.FrameExit {
+			continue
+		}
+		var exit agent.ExecExit
+		if err := json.Unmarshal(payload, &exit); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
 		}
+		if exit.Error != "" {
+			return fmt.Errorf("failed to write %s: %s", path, exit.Error)
+		}
+		return nil
 	}
-
-	return response
 }
 
-// CreateVMAgentBinary creates the VM agent binary content
-func CreateVMAgentBinary() string {
-	return `#!/bin/sh
-# VM Agent for exec support
-# This runs inside the Firecracker VM
-
-echo "Starting VM agent..."
-
-# Simple netcat-based agent for exec
-while true; do
-    nc -l -p 1024 -e /bin/sh 2>/dev/null || {
-        # Fallback: simple command server
-        (echo "VM Agent Ready"; while read line; do eval "$line" 2>&1; done) | nc -l -p 1024
-    }
-done
-`
-}
+// Signal sends a signal to the workload in the guest
+func (c *VMExecClient) Signal(ctx context.Context, sig syscall.Signal) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to VM agent: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
 
-// VM exec client implementation for the driver
-type VMExecClient struct {
-	vmInfo *VMInfo
-	logger hclog.Logger
+	out := agent.NewFrameWriter(conn)
+	if err := out.WriteJSON(agent.FrameSignal, &agent.SignalRequest{Signal: int(sig)}); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	for {
+		typ, payload, err := agent.ReadFrame(conn)
+		if err != nil {
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+		if typ != agent.FrameExit {
+			continue
+		}
+		var exit agent.ExecExit
+		if err := json.Unmarshal(payload, &exit); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		if exit.Error != "" {
+			return fmt.Errorf("failed to send %s: %s", sig, exit.Error)
+		}
+		return nil
+	}
 }
 
-// NewVMExecClient creates a new VM exec client
-func NewVMExecClient(vmInfo *VMInfo, logger hclog.Logger) *VMExecClient {
-	return &VMExecClient{
-		vmInfo: vmInfo,
-		logger: logger.Named("vm_exec_client"),
+// dial connects to the VM agent through the host side of the VM's vsock
+// device, which forwards the connection to the agent's port after a
+// CONNECT handshake
+func (c *VMExecClient) dial(ctx context.Context) (net.Conn, error) {
+	if c.vmInfo.VsockPath == "" {
+		return nil, fmt.Errorf("VM has no vsock device")
 	}
+	return fcvsock.DialContext(ctx, c.vmInfo.VsockPath, agent.VsockPort,
+		fcvsock.WithRetryTimeout(5*time.Second))
 }
 
-// ExecuteCommand executes a command in the VM
-func (c *VMExecClient) ExecuteCommand(ctx context.Context, command []string, timeout time.Duration) (*ExecResponse, error) {
-	// For now, we'll use a simple approach - write commands to the VM via serial console
-	// In production, you'd want to use vsock or network communication
-	
-	c.logger.Info("executing command in VM", "command", command, "vm_id", c.vmInfo.VMID)
-	
-	// Try to connect to the VM agent
-	conn, err := net.DialTimeout("tcp", "127.0.0.1:1024", 5*time.Second)
-	if err != nil {
-		// Fallback: simulate execution for demo
-		return &ExecResponse{
-			ExitCode: 0,
-			Stdout:   fmt.Sprintf("Simulated execution: %s\n", strings.Join(command, " ")),
-			Stderr:   "",
-		}, nil
+// runSession speaks the exec protocol on conn until the agent reports the
+// command's exit. stdin and resizeCh may be nil.
+func (c *VMExecClient) runSession(ctx context.Context, conn net.Conn, req *agent.ExecRequest, stdin io.Reader, stdout, stderr io.Writer, resizeCh <-chan drivers.TerminalSize) (*agent.ExecExit, error) {
+	out := agent.NewFrameWriter(conn)
+	if err := out.WriteJSON(agent.FrameStart, req); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer conn.Close()
 
-	// Set timeout
-	if timeout > 0 {
-		conn.SetDeadline(time.Now().Add(timeout))
-	}
+	done := make(chan struct{})
+	defer close(done)
 
-	// Send request
-	req := &ExecRequest{
-		Command: command,
-		Timeout: int(timeout.Seconds()),
+	// Closing the connection unblocks the reads below when ctx ends
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if stdin == nil {
+		out.WriteFrame(agent.FrameStdin, nil)
+	} else {
+		go func() {
+			io.Copy(out.StreamWriter(agent.FrameStdin), stdin)
+			out.WriteFrame(agent.FrameStdin, nil)
+		}()
 	}
 
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(req); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+	if resizeCh != nil {
+		go func() {
+			for {
+				select {
+				case size, ok := <-resizeCh:
+					if !ok {
+						return
+					}
+					out.WriteJSON(agent.FrameResize, agent.TerminalSize{Height: size.Height, Width: size.Width})
+				case <-done:
+					return
+				}
+			}
+		}()
 	}
 
 	// Read response
-	decoder := json.NewDecoder(conn)
-	var response ExecResponse
-	if err := decoder.Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
+	for {
+		typ, payload, err := agent.ReadFrame(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
 
-	return &response, nil
-} 
\ No newline at end of file
+		switch typ {
+		case agent.FrameStdout:
+			stdout.Write(payload)
+		case agent.FrameStderr:
+			stderr.Write(payload)
+		case agent.FrameExit:
+			var exit agent.ExecExit
+			if err := json.Unmarshal(payload, &exit); err != nil {
+				return nil, fmt.Errorf("failed to decode exit status: %w", err)
+			}
+			return &exit, nil
+		}
+	}
+}
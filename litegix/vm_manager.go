@@ -16,11 +16,26 @@ import (
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/shadm/nomad-litegix-fc-driver/litegix/vminit"
 )
 
 const (
 	defaultTimeout = 30 * time.Second
 
+	// recoverAPIAttempts is how often the API of a recovered VM is tried,
+	// a second apart
+	recoverAPIAttempts = 5
+
+	// statusDriveName is the file backing the drive the guest init reports the
+	// workload's exit status on. It is attached right after the rootfs, so
+	// the guest sees it as statusDevice.
+	statusDriveName = "status.img"
+	statusDevice    = "/dev/vdb"
+	statusDriveSize = 4096
+
 	// VM State constants for Nomad compatibility
 	VMStateCreated  = "created"
 	VMStateRunning  = "running"
@@ -31,16 +46,48 @@ const (
 )
 
 type VMManager interface {
-	CreateAndStartVM(ctx context.Context, config *TaskConfig, taskID string, stdout, stderr io.Writer) (*VMInfo, error)
-	StopVM(ctx context.Context, vmInfo *VMInfo, timeout time.Duration) error
+	CreateAndStartVM(ctx context.Context, cfg *drivers.TaskConfig, config *TaskConfig, stdout, stderr io.Writer) (*VMInfo, error)
+	// StopVM asks the workload to exit with sig, or the guest to shut down
+	// when sig is 0, and stops the VMM once timeout has passed
+	StopVM(ctx context.Context, vmInfo *VMInfo, timeout time.Duration, sig syscall.Signal) error
 	DestroyVM(ctx context.Context, vmInfo *VMInfo) error
 	GetVMStatus(ctx context.Context, vmInfo *VMInfo) (*VMStatus, error)
+
+	// RecoverVM reattaches to the running VM described by vmInfo after a
+	// plugin restart, filling in its Machine and ExecClient
+	RecoverVM(ctx context.Context, vmInfo *VMInfo) error
+
+	// PauseVM freezes the guest's vCPUs without stopping the VMM, and
+	// ResumeVM lets the guest continue where it was paused
+	PauseVM(ctx context.Context, vmInfo *VMInfo) error
+	ResumeVM(ctx context.Context, vmInfo *VMInfo) error
+}
+
+// rootfsProvider supplies the writable root filesystem of a task
+type rootfsProvider interface {
+	// Prepare makes a writable rootfs for taskID from image. Files it
+	// creates for the task are placed in vmDir.
+	Prepare(ctx context.Context, image, taskID, vmDir string) (*taskRootfs, error)
+
+	// Release frees the rootfs prepared for taskID
+	Release(ctx context.Context, taskID string, rootfs *taskRootfs) error
+}
+
+// taskRootfs is a task's root drive as returned by a rootfsProvider
+type taskRootfs struct {
+	// Path is the file image or block device backing the drive
+	Path        string
+	ImageDigest digest.Digest
+
+	// ImageConfig is the image's runtime config, such as its Entrypoint
+	ImageConfig *ocispec.ImageConfig
 }
 
 type VMStatus struct {
 	State    string
 	PID      uint32
 	ExitCode *uint32
+	Signal   int
 	ExitedAt *time.Time
 	Error    error
 }
@@ -49,80 +96,87 @@ type VMInfo struct {
 	TaskID      string
 	VMID        string
 	Machine     *firecracker.Machine
+	VMDir       string
 	SocketPath  string
+	VsockPath   string
 	RootfsPath  string
 	PID         uint32
 	CreatedAt   time.Time
 	ExecClient  *VMExecClient
+	ImageDigest digest.Digest
+
+	// NetworkMode is how the VM is connected, networkModeCNI or
+	// networkModeGroup. NetNS is the network namespace firecracker runs in
+	// and GuestIP the guest's address there, all empty when VMs get no
+	// network. TapName is the VM's tap device on a group network.
+	NetworkMode string
+	NetNS       string
+	GuestIP     string
+	TapName     string
+
+	// PortMappings are the allocated ports forwarded to the guest
+	PortMappings []portMapping
+
+	// TaskDirs are the task directories shared with the guest
+	TaskDirs    []taskDir
+	taskDirSync *taskDirSyncer
+
+	// JailID, JailDir and JailUID describe the chroot of a VMM run by the
+	// jailer, all empty otherwise
+	JailID  string
+	JailDir string
+	JailUID int
+
+	// Cgroup is the cgroup confining the VMM, relative to the cgroup root
+	Cgroup string
+
+	// VolumeLocks are the locks held on the VM's volumes
+	VolumeLocks []volumeLock
+
+	// cancel releases the context the machine was started with
+	cancel context.CancelFunc
 }
 
 type firecrackerVMManager struct {
 	config *Config
 	logger hclog.Logger
+	rootfs rootfsProvider
+
+	// jailUIDs tracks the uids of jailed VMMs
+	jailUIDs jailUIDs
 }
 
-// NewVMManager creates a new VM manager instance
-func NewVMManager(config *Config, logger hclog.Logger) VMManager {
-	return &firecrackerVMManager{
+// NewVMManager creates a new VM manager instance. Images are pulled through
+// containerd when a containerd socket is configured, and straight from their
+// registries into the driver's own cache otherwise.
+func NewVMManager(config *Config, logger hclog.Logger) (VMManager, error) {
+	logger = logger.Named("vm_manager")
+	vm := &firecrackerVMManager{
 		config: config,
-		logger: logger.Named("vm_manager"),
+		logger: logger,
 	}
-}
-
-// OCI image manifest structure for pulling images
-type OCIManifest struct {
-	SchemaVersion int    `json:"schemaVersion"`
-	MediaType     string `json:"mediaType"`
-	Config        struct {
-		MediaType string `json:"mediaType"`
-		Size      int64  `json:"size"`
-		Digest    string `json:"digest"`
-	} `json:"config"`
-	Layers []struct {
-		MediaType string `json:"mediaType"`
-		Size      int64  `json:"size"`
-		Digest    string `json:"digest"`
-	} `json:"layers"`
-}
 
-func (vm *firecrackerVMManager) pullOCIImage(ctx context.Context, imageName, targetDir string) error {
-	logger := vm.logger.With("image", imageName, "target_dir", targetDir)
-	
-	// For simplicity, we'll use Docker to pull the image and extract it
-	// In production, you might want to use a proper OCI image library
-	logger.Info("pulling OCI image using Docker")
-	
-	// Pull the image using Docker
-	cmd := exec.CommandContext(ctx, "docker", "pull", imageName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to pull image with docker: %w", err)
-	}
-	
-	// Create the target directory
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create target directory: %w", err)
-	}
-	
-	// Export the image to a tar file
-	tarPath := filepath.Join(targetDir, "image.tar")
-	cmd = exec.CommandContext(ctx, "docker", "save", "-o", tarPath, imageName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to save image: %w", err)
+	if config.ContainerdSocket != "" {
+		provider, err := newContainerdRootfs(config.ContainerdSocket, config.ContainerdNamespace, config.ContainerdSnapshotter, logger)
+		if err != nil {
+			return nil, err
+		}
+		vm.rootfs = provider
+		return vm, nil
 	}
-	
-	// Extract the tar file
-	cmd = exec.CommandContext(ctx, "tar", "-xf", tarPath, "-C", targetDir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to extract image tar: %w", err)
+
+	gcDelay := defaultImageGCDelay
+	if config.ImageGCDelay != "" {
+		// SetConfig has already validated the duration
+		gcDelay, _ = time.ParseDuration(config.ImageGCDelay)
 	}
-	
-	// Remove the tar file
-	os.Remove(tarPath)
-	
-	logger.Info("successfully pulled and extracted OCI image")
-	return nil
+	cacheDir := filepath.Join(config.RootfsBasePath, "cache")
+	vm.rootfs = newImageCache(cacheDir, newRegistryClient(nil, logger), vm.createRootfs, gcDelay, logger)
+	return vm, nil
 }
 
+// createRootfs builds the pristine rootfs for a pulled image. The result is
+// shared by every task using the image, so nothing task specific goes in.
 func (vm *firecrackerVMManager) createRootfs(ctx context.Context, imageDir, rootfsPath string) error {
 	logger := vm.logger.With("image_dir", imageDir, "rootfs_path", rootfsPath)
 	
@@ -158,168 +212,229 @@ func (vm *firecrackerVMManager) createRootfs(ctx context.Context, imageDir, root
 	
 	logger.Info("extracting image layers", "layer_count", len(manifest.Layers))
 	
-	// Extract all layers in order
+	// Extract all layers in order, applying whiteouts as we go
+	applier := newLayerApplier(tempDir)
 	for i, layer := range manifest.Layers {
 		layerPath := filepath.Join(imageDir, layer)
 		logger.Debug("extracting layer", "layer", i+1, "path", layerPath)
-		
-		cmd := exec.CommandContext(ctx, "tar", "-xf", layerPath, "-C", tempDir)
-		if err := cmd.Run(); err != nil {
+
+		if err := applier.Apply(ctx, layerPath); err != nil {
 			return fmt.Errorf("failed to extract layer %s: %w", layer, err)
 		}
 	}
 	
-	// Create an ext4 filesystem image
+	// Create an ext4 filesystem image straight from the extracted tree,
+	// without mounting it
 	logger.Info("creating ext4 filesystem image")
-	
-	// Calculate size (add some buffer space)
-	cmd := exec.CommandContext(ctx, "du", "-sb", tempDir)
-	output, err := cmd.Output()
+	sizeMB, err := buildExt4(ctx, tempDir, rootfsPath, applier.fixups)
 	if err != nil {
-		return fmt.Errorf("failed to calculate directory size: %w", err)
+		return err
 	}
-	
-	sizeStr := strings.Fields(string(output))[0]
-	size, err := strconv.ParseInt(sizeStr, 10, 64)
-	if err != nil {
-		return fmt.Errorf("failed to parse size: %w", err)
-	}
-	
-	// Add 50% buffer and round up to MB
-	sizeWithBuffer := size * 3 / 2
-	sizeMB := (sizeWithBuffer + 1024*1024 - 1) / (1024 * 1024)
-	if sizeMB < 100 {
-		sizeMB = 100 // Minimum 100MB
-	}
-	
-	// Create empty file
-	cmd = exec.CommandContext(ctx, "dd", "if=/dev/zero", "of="+rootfsPath, 
-		"bs=1M", "count="+strconv.FormatInt(sizeMB, 10))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create rootfs file: %w", err)
-	}
-	
-	// Format as ext4
-	cmd = exec.CommandContext(ctx, "mkfs.ext4", "-F", rootfsPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to format rootfs: %w", err)
-	}
-	
-	// Mount the filesystem
-	mountDir, err := os.MkdirTemp("", "rootfs-mount-")
+
+	logger.Info("successfully created rootfs", "size_mb", sizeMB)
+	return nil
+}
+
+// customizeRootfs adds the guest init, its config and the VM agent to a
+// task's rootfs. Providers hand out pristine image contents, so this runs
+// for every task. Files are written into the image with debugfs rather
+// than through a mount.
+func (vm *firecrackerVMManager) customizeRootfs(ctx context.Context, rootfsPath, hostname string, process *imageProcess, mounts []vminit.Mount, links []vminit.DeviceLink) error {
+	initBinary, err := guestBinary("litegix-init")
 	if err != nil {
-		return fmt.Errorf("failed to create mount dir: %w", err)
-	}
-	defer os.RemoveAll(mountDir)
-	
-	cmd = exec.CommandContext(ctx, "mount", "-o", "loop", rootfsPath, mountDir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to mount rootfs: %w", err)
+		return err
 	}
-	defer exec.CommandContext(ctx, "umount", mountDir).Run()
-	
-	// Copy the extracted filesystem to the mounted image
-	cmd = exec.CommandContext(ctx, "cp", "-a", tempDir+"/.", mountDir+"/")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy filesystem: %w", err)
-	}
-	
+	files := []guestFile{{Path: guestInitPath, Mode: 0755, Data: initBinary}}
+
 	// Add VM agent for exec support
-	if err := vm.addVMAgentToRootfs(mountDir); err != nil {
-		logger.Warn("failed to add VM agent", "error", err)
-		// Continue without agent - exec will still work in fallback mode
+	agentFiles, err := vm.vmAgentFiles()
+	if err != nil {
+		vm.logger.Warn("failed to add VM agent, exec will not be available", "error", err)
 	}
+	files = append(files, agentFiles...)
 
-	// Create an /init script to run the user's command
-	if err := vm.createInitScript(mountDir, config); err != nil {
-		logger.Error("failed to create /init script", "error", err)
-		return fmt.Errorf("failed to create /init script: %w", err)
+	initConfig, err := vm.createInitConfig(ctx, rootfsPath, hostname, process, mounts, links, len(agentFiles) > 0)
+	if err != nil {
+		return fmt.Errorf("failed to create init config: %w", err)
 	}
+	files = append(files, initConfig)
 
-	logger.Info("successfully created rootfs", "size_mb", sizeMB)
+	if err := writeExt4Files(ctx, rootfsPath, files); err != nil {
+		return fmt.Errorf("failed to write files to rootfs: %w", err)
+	}
 	return nil
 }
 
-// createInitScript creates a simple /init script inside the rootfs that will
-// execute the task's command.
-func (vm *firecrackerVMManager) createInitScript(mountDir string, taskConfig *TaskConfig) error {
-	initScriptPath := filepath.Join(mountDir, "init")
-	var commandToRun string
-
-	if taskConfig.Command != "" {
-		commandToRun = fmt.Sprintf("exec %s %s", taskConfig.Command, taskConfig.Args)
-	} else {
-		// If no command is given, just start a shell
-		commandToRun = "exec /bin/sh"
+// createInitConfig creates the config the guest init runs the task's
+// workload from
+func (vm *firecrackerVMManager) createInitConfig(ctx context.Context, rootfsPath, hostname string, process *imageProcess, mounts []vminit.Mount, links []vminit.DeviceLink, withAgent bool) (guestFile, error) {
+	config := vminit.Config{
+		Args:         process.Args,
+		Env:          mergeEnv([]string{"PATH=" + defaultPath, "HOME=/root"}, process.Env),
+		WorkingDir:   process.WorkingDir,
+		Hostname:     hostname,
+		StatusDevice: statusDevice,
+		Mounts:       mounts,
+		DeviceLinks:  links,
+	}
+	if withAgent {
+		config.AgentPath = guestAgentPath
+		config.AgentLogPath = guestDir + "/agent.log"
+	}
+
+	// Drop privileges when the image or task asks for another user. The
+	// user is resolved on the host, so only numeric IDs reach the guest.
+	if process.User != "" {
+		passwd, err := readExt4File(ctx, rootfsPath, "/etc/passwd")
+		if err != nil {
+			return guestFile{}, err
+		}
+		group, err := readExt4File(ctx, rootfsPath, "/etc/group")
+		if err != nil {
+			return guestFile{}, err
+		}
+		uid, gid, err := lookupUser(passwd, group, process.User)
+		if err != nil {
+			return guestFile{}, err
+		}
+		config.UID, config.GID = uint32(uid), uint32(gid)
 	}
 
-	// This is a very basic init script. A more robust implementation might
-	// use a proper init system like tini or a simple Go program.
-	scriptContent := fmt.Sprintf(`#!/bin/sh
-# This script is PID 1 in the VM. It executes the user's command.
-echo "VM init script started"
-
-# Setup basic environment
-export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
-export HOME=/root
-%s
+	data, err := json.Marshal(config)
+	if err != nil {
+		return guestFile{}, err
+	}
 
-# Execute the user's command
-echo "Executing command: %s"
-%s
+	vm.logger.Info("created init config", "args", process.Args, "user", process.User)
+	// The config holds the task's environment, secrets included
+	return guestFile{Path: vminit.ConfigPath, Mode: 0600, Data: data}, nil
+}
 
-# After command finishes, power off the VM
-echo "Command finished with exit code $?. Shutting down."
-poweroff -f
-`, envVarsToString(taskConfig.Env), commandToRun, commandToRun)
+func (vm *firecrackerVMManager) CreateAndStartVM(ctx context.Context, cfg *drivers.TaskConfig, config *TaskConfig, stdout, stderr io.Writer) (*VMInfo, error) {
+	taskID := cfg.ID
+	logger := vm.logger.With("task_id", taskID, "image", config.Image)
 
-	err := os.WriteFile(initScriptPath, []byte(scriptContent), 0755)
+	// Size the VM from the task's resources before doing any work
+	size, err := sizeVM(cfg.Resources, config, vm.config)
 	if err != nil {
-		return fmt.Errorf("failed to write /init script: %w", err)
+		return nil, err
 	}
 
-	vm.logger.Info("created /init script", "command", commandToRun)
-	return nil
-}
-
-// envVarsToString converts a slice of env vars to a string of export statements.
-func envVarsToString(env []string) string {
-	var builder strings.Builder
-	for _, e := range env {
-		builder.WriteString(fmt.Sprintf("export %s\n", e))
+	// A group network namespace takes precedence over the CNI network
+	var network *groupNetwork
+	if iso := cfg.NetworkIsolation; iso != nil && iso.Mode == drivers.NetIsolationModeGroup && iso.Path != "" {
+		network = newGroupNetwork(cfg.Name)
 	}
-	return builder.String()
-}
 
+	portMappings, err := taskPortMappings(config.Ports, cfg.Resources)
+	if err != nil {
+		return nil, err
+	}
+	if len(portMappings) > 0 && network == nil && vm.config.CNINetwork == "" {
+		return nil, fmt.Errorf("ports requires a group network or cni_network")
+	}
 
-func (vm *firecrackerVMManager) CreateAndStartVM(ctx context.Context, config *TaskConfig, taskID string, stdout, stderr io.Writer) (*VMInfo, error) {
-	logger := vm.logger.With("task_id", taskID, "image", config.Image)
+	volumes, err := taskVolumes(cfg, config, vm.config)
+	if err != nil {
+		return nil, err
+	}
 	
-	// Create directories for this VM
+	// Create directories for this VM. The drives in it carry the task's
+	// environment and files, so only root may enter it.
 	vmDir := filepath.Join(vm.config.RootfsBasePath, taskID)
-	if err := os.MkdirAll(vmDir, 0755); err != nil {
+	if err := os.MkdirAll(vmDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create VM directory: %w", err)
+	}
+	if err := os.Chmod(vmDir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create VM directory: %w", err)
 	}
 	
-	imageDir := filepath.Join(vmDir, "image")
-	rootfsPath := filepath.Join(vmDir, "rootfs.ext4")
 	socketPath := filepath.Join(vmDir, "firecracker.sock")
-	
-	// Pull and extract the OCI image
-	logger.Info("pulling OCI image")
-	if err := vm.pullOCIImage(ctx, config.Image, imageDir); err != nil {
-		return nil, fmt.Errorf("failed to pull OCI image: %w", err)
+
+	// Get a writable rootfs for the task. Images are pulled and converted
+	// only if no other task has done so already.
+	logger.Info("preparing rootfs from OCI image")
+	rootfs, err := vm.rootfs.Prepare(ctx, config.Image, taskID, vmDir)
+	if err != nil {
+		os.RemoveAll(vmDir)
+		return nil, fmt.Errorf("failed to prepare rootfs: %w", err)
+	}
+	rootfsPath := rootfs.Path
+
+	started := false
+	var jail *vmJail
+	var cgroup string
+	var locks []volumeLock
+	defer func() {
+		if !started {
+			unlockVolumes(locks)
+			removeVMMCgroup(cgroup)
+			vm.releaseJail(jail)
+			vm.rootfs.Release(context.WithoutCancel(ctx), taskID, rootfs)
+			os.RemoveAll(vmDir)
+		}
+	}()
+
+	// Give the VMM a chroot and uid of its own when the jailer is enabled
+	if vm.config.Jailer.Enabled {
+		jail, err = vm.newJail(cfg.AllocID, taskID, vmDir)
+		if err != nil {
+			return nil, err
+		}
 	}
-	
-	// Create rootfs from the OCI image
-	logger.Info("creating rootfs from OCI image")
-	if err := vm.createRootfs(ctx, imageDir, rootfsPath); err != nil {
+
+	// Confine the VMM to the task's share of the host, in a cgroup named
+	// like its jail
+	limits := vmmCgroupLimits(cfg.Resources, size, vm.config)
+	cgroup, err = vm.createVMMCgroup(jailID(cfg.AllocID, taskID), limits)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("confining VMM", "cgroup", cgroup, "cpu_quota", limits.CPUQuota, "memory", limits.MemoryBytes, "cpuset", limits.Cpuset)
+
+	// Work out the workload process from the image config and the task
+	taskEnv := cfg.Env
+	if network != nil {
+		taskEnv = network.upstreamEnv(taskEnv)
+	}
+	process := mergeImageConfig(rootfs.ImageConfig, config, taskEnv, cfg.User, config.WorkDir)
+
+	// Snapshot the task directories into drives attached after the root
+	// and status drives. Files changing later are copied to the running
+	// guest.
+	dirs := taskDirs(cfg)
+	dirFiles := scanTaskDirs(dirs)
+	dirDrives, mounts, err := buildTaskDirDrives(ctx, vmDir, dirs, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	// Volumes get the drives after those
+	volumeDrives, volumeMounts, links, err := vm.volumeDrives(ctx, vmDir, volumes, 2+len(dirDrives))
+	if err != nil {
+		return nil, err
+	}
+	mounts = append(mounts, volumeMounts...)
+	locks, err = lockVolumes(volumeDrives, vmDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the task specific files to the rootfs
+	logger.Info("customizing rootfs", "digest", rootfs.ImageDigest)
+	if err := vm.customizeRootfs(ctx, rootfsPath, cfg.Name, process, mounts, links); err != nil {
 		return nil, fmt.Errorf("failed to create rootfs: %w", err)
 	}
 	
 	// Prepare firecracker configuration
 	logger.Info("configuring firecracker VM")
 	
+	// Create the drive the guest reports the workload's exit status on
+	statusPath := filepath.Join(vmDir, statusDriveName)
+	if err := createStatusDrive(statusPath); err != nil {
+		return nil, err
+	}
+
 	// Configure drives
 	drives := []models.Drive{
 		{
@@ -328,50 +443,134 @@ func (vm *firecrackerVMManager) CreateAndStartVM(ctx context.Context, config *Ta
 			IsRootDevice: firecracker.Bool(true),
 			IsReadOnly:   firecracker.Bool(false),
 		},
+		{
+			DriveID:      firecracker.String("status"),
+			PathOnHost:   &statusPath,
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(false),
+		},
 	}
+	drives = append(drives, dirDrives...)
+	drives = append(drives, volumeDrives...)
 	
 	// Configure vsock for exec communication
+	vsockPath := socketPath + ".vsock"
 	vsockDevices := []firecracker.VsockDevice{
 		{
-			Path: socketPath + ".vsock",
-			CID:  3,   // Guest CID
+			Path: vsockPath,
+			CID:  guestCID,
 		},
 	}
 	
 	// Configure machine
 	machineConfig := models.MachineConfiguration{
-		VcpuCount:  firecracker.Int64(int64(config.VpuCount)),
-		MemSizeMib: firecracker.Int64(int64(config.MemSize)),
+		VcpuCount:  firecracker.Int64(int64(size.VCPUs)),
+		MemSizeMib: firecracker.Int64(int64(size.MemMiB)),
 	}
+	logger.Info("sizing VM", "vcpus", size.VCPUs, "mem_mib", size.MemMiB)
 	
 	// Create firecracker machine configuration
 	fcConfig := firecracker.Config{
-		SocketPath:      socketPath,
-		KernelImagePath: vm.config.VmlinuxPath,
-		KernelArgs:      "console=ttyS0 reboot=k panic=1 pci=off init=/init",
-		Drives:          drives,
-		MachineCfg:      machineConfig,
-		VsockDevices:    vsockDevices,
+		SocketPath:        socketPath,
+		KernelImagePath:   vm.config.VmlinuxPath,
+		KernelArgs:        "console=ttyS0 reboot=k panic=1 pci=off init=" + guestInitPath,
+		Drives:            drives,
+		MachineCfg:        machineConfig,
+		VsockDevices:      vsockDevices,
+		VMID:              taskID,
+
+		// The VM must outlive plugin restarts, so signals sent to the
+		// plugin are not passed on to firecracker
+		ForwardSignals: []os.Signal{},
+	}
+
+	// A jailed VMM sees its sockets and files at the root of its chroot.
+	// The SDK moves SocketPath into the chroot, and the drives and kernel
+	// are linked there when it is created. Seccomp is left to firecracker's
+	// default filters.
+	if jail != nil {
+		fcConfig.SocketPath = jailSocketPath
+		fcConfig.VsockDevices[0].Path = jailVsockPath
+		vsockPath = filepath.Join(jail.Dir, jailVsockPath)
+		fcConfig.JailerCfg = jail.jailerConfig(vm.config.Jailer, stdout, stderr)
+		fcConfig.Seccomp.Enabled = true
+	}
+
+	// Connect the VM to the network
+	networkMode := ""
+	if network != nil {
+		if err := network.setup(cfg.NetworkIsolation.Path); err != nil {
+			return nil, fmt.Errorf("failed to set up group network: %w", err)
+		}
+		networkMode = networkModeGroup
+		fcConfig.NetworkInterfaces = network.networkInterfaces(groupNameservers(cfg.DNS))
+		fcConfig.NetNS = cfg.NetworkIsolation.Path
+	} else if interfaces := vm.networkInterfaces(); len(interfaces) > 0 {
+		networkMode = networkModeCNI
+		fcConfig.NetworkInterfaces = interfaces
+		fcConfig.NetNS = filepath.Join(netNSDir, taskID)
 	}
 
 	// Create a context for the machine, and wire up the stdio.
 	machineCtx, machineCancel := context.WithCancel(ctx)
 	
+	// Build the firecracker command so the guest console is forwarded to
+	// the task's log FIFOs
+	var cmd *exec.Cmd
+	if jail != nil {
+		cmd = jail.command(machineCtx, &fcConfig)
+	} else {
+		cmd = firecracker.VMCommandBuilder{}.
+			WithBin("firecracker").
+			WithSocketPath(socketPath).
+			WithStdout(stdout).
+			WithStderr(stderr).
+			Build(machineCtx)
+
+		// Keep firecracker out of the plugin's process group so it is not
+		// killed along with the plugin
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
 	// Create and start the VM
-	machine, err := firecracker.NewMachine(machineCtx, fcConfig, firecracker.Withstdio(os.Stdin, stdout, stderr))
+	machine, err := firecracker.NewMachine(machineCtx, fcConfig, firecracker.WithProcessRunner(cmd))
 	if err != nil {
 		machineCancel()
 		return nil, fmt.Errorf("failed to create firecracker machine: %w", err)
 	}
+
+	machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+		firecracker.StartVMMHandlerName,
+		placeInCgroupHandler(cgroup),
+	)
+
+	// Add an empty balloon that only reports the guest's memory statistics
+	machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+		firecracker.CreateMachineHandlerName,
+		firecracker.NewCreateBalloonHandler(0, true, balloonStatsInterval),
+	)
 	
-	if err := machine.Start(machineCtx); err != nil {
+	err = machine.Start(machineCtx)
+	if jail != nil {
+		// The VMM holds the volumes' loop devices open from here on
+		jail.closeLoops()
+	}
+	if err != nil {
 		machineCancel()
 		return nil, fmt.Errorf("failed to start firecracker VM: %w", err)
 	}
+	switch networkMode {
+	case networkModeGroup:
+		logger.Info("connected VM to group network", "netns", fcConfig.NetNS, "tap", network.TapName, "ip", guestIP(machine))
+	case networkModeCNI:
+		logger.Info("connected VM to CNI network", "network", vm.config.CNINetwork, "ip", guestIP(machine))
+	}
 
 	// Get the PID
 	pid, err := machine.PID()
 	if err != nil {
+		machine.StopVMM()
+		machineCancel()
 		return nil, fmt.Errorf("failed to get VM PID: %w", err)
 	}
 	
@@ -379,50 +578,145 @@ func (vm *firecrackerVMManager) CreateAndStartVM(ctx context.Context, config *Ta
 	
 	// Create VM info with exec client
 	vmInfo := &VMInfo{
-		TaskID:     taskID,
-		VMID:       taskID,
-		Machine:    machine,
-		SocketPath: socketPath,
-		RootfsPath: rootfsPath,
-		PID:        uint32(pid),
-		CreatedAt:  time.Now(),
+		TaskID:       taskID,
+		VMID:         taskID,
+		Machine:      machine,
+		VMDir:        vmDir,
+		SocketPath:   machine.Cfg.SocketPath,
+		VsockPath:    vsockPath,
+		RootfsPath:   rootfsPath,
+		PID:          uint32(pid),
+		CreatedAt:    time.Now(),
+		ImageDigest:  rootfs.ImageDigest,
+		NetworkMode:  networkMode,
+		NetNS:        fcConfig.NetNS,
+		GuestIP:      guestIP(machine),
+		PortMappings: portMappings,
+		TaskDirs:     dirs,
+		cancel:       machineCancel,
+	}
+	if network != nil {
+		vmInfo.TapName = network.TapName
+	}
+	if jail != nil {
+		vmInfo.JailID = jail.ID
+		vmInfo.JailDir = jail.Dir
+		vmInfo.JailUID = jail.UID
+	}
+	vmInfo.Cgroup = cgroup
+	vmInfo.VolumeLocks = locks
+
+	// Forward the task's ports to the guest
+	if err := vm.setupPorts(vmInfo); err != nil {
+		vm.teardownPorts(vmInfo)
+		machine.StopVMM()
+		machineCancel()
+		return nil, fmt.Errorf("failed to forward ports: %w", err)
 	}
+	started = true
 	
 	// Initialize exec client
 	vmInfo.ExecClient = NewVMExecClient(vmInfo, vm.logger)
+	vmInfo.taskDirSync = newTaskDirSyncer(dirs, dirFiles, vmInfo.ExecClient, vm.logger)
 	
 	return vmInfo, nil
 }
 
-func (vm *firecrackerVMManager) StopVM(ctx context.Context, vmInfo *VMInfo, timeout time.Duration) error {
+func (vm *firecrackerVMManager) StopVM(ctx context.Context, vmInfo *VMInfo, timeout time.Duration, sig syscall.Signal) error {
 	logger := vm.logger.With("task_id", vmInfo.TaskID, "vm_id", vmInfo.VMID)
 	
-	logger.Info("stopping VM", "timeout", timeout)
+	logger.Info("stopping VM", "timeout", timeout, "signal", sig)
+	if vmInfo.Machine == nil || !vmmAlive(vmInfo) {
+		return nil
+	}
 	
 	stopCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
+
+	// A paused guest cannot react to the shutdown request
+	if vmPaused(stopCtx, vmInfo) {
+		if err := vm.ResumeVM(stopCtx, vmInfo); err != nil {
+			logger.Warn("failed to resume paused VM before shutdown", "error", err)
+		}
+	}
+
+	// The task's kill signal goes to the workload through the agent. The
+	// guest init shuts the VM down once the workload exits.
+	signaled := false
+	if sig != 0 && vmInfo.ExecClient != nil {
+		if err := vmInfo.ExecClient.Signal(stopCtx, sig); err != nil {
+			logger.Warn("failed to signal workload, shutting down the guest instead", "error", err)
+		} else {
+			signaled = true
+		}
+	}
 	
-	if err := vmInfo.Machine.Shutdown(stopCtx); err != nil {
-		logger.Warn("failed to shutdown gracefully, stopping forcefully", "error", err)
-		return vmInfo.Machine.StopVMM()
+	// Otherwise Shutdown sends Ctrl+Alt+Del, on which the guest init stops
+	// the workload with SIGTERM and reboots, which ends firecracker
+	if !signaled {
+		if err := vmInfo.Machine.Shutdown(stopCtx); err != nil {
+			logger.Warn("failed to shutdown gracefully, stopping forcefully", "error", err)
+			return stopVMM(vmInfo)
+		}
+	}
+
+	if !waitVMMExit(stopCtx, vmInfo) {
+		logger.Warn("VM did not shut down within timeout, stopping forcefully")
+		return stopVMM(vmInfo)
 	}
 	
 	logger.Info("VM stopped successfully")
 	return nil
 }
 
+// waitVMMExit waits for the firecracker process of a VM to exit, reporting
+// false if it is still running when ctx ends
+func waitVMMExit(ctx context.Context, vmInfo *VMInfo) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for vmmAlive(vmInfo) {
+		select {
+		case <-ctx.Done():
+			return !vmmAlive(vmInfo)
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
 func (vm *firecrackerVMManager) DestroyVM(ctx context.Context, vmInfo *VMInfo) error {
 	logger := vm.logger.With("task_id", vmInfo.TaskID, "vm_id", vmInfo.VMID)
 	
 	logger.Info("destroying VM")
 	
 	// Stop the VM if it's still running
-	if vmInfo.Machine != nil {
-		vmInfo.Machine.StopVMM()
+	stopVMM(vmInfo)
+	if vmInfo.cancel != nil {
+		vmInfo.cancel()
 	}
 	
+	if err := vm.teardownPorts(vmInfo); err != nil {
+		logger.Warn("failed to remove port forwarding", "error", err)
+	}
+	if err := vm.teardownNetwork(ctx, vmInfo); err != nil {
+		logger.Warn("failed to tear down VM network", "error", err)
+	}
+	if err := vm.releaseJail(vmInfo.jail()); err != nil {
+		logger.Warn("failed to remove VM chroot", "error", err)
+	}
+	if err := removeVMMCgroup(vmInfo.Cgroup); err != nil {
+		logger.Warn("failed to remove VMM cgroup", "error", err)
+	}
+	unlockVolumes(vmInfo.VolumeLocks)
+
+	// Release the task's rootfs before its VM directory goes away
+	rootfs := &taskRootfs{Path: vmInfo.RootfsPath, ImageDigest: vmInfo.ImageDigest}
+	if err := vm.rootfs.Release(ctx, vmInfo.TaskID, rootfs); err != nil {
+		logger.Warn("failed to release rootfs", "error", err)
+	}
+
 	// Clean up VM directory
-	vmDir := filepath.Dir(vmInfo.RootfsPath)
+	vmDir := vmInfo.VMDir
 	if err := os.RemoveAll(vmDir); err != nil {
 		logger.Warn("failed to clean up VM directory", "error", err, "dir", vmDir)
 		return fmt.Errorf("failed to clean up VM directory: %w", err)
@@ -435,84 +729,223 @@ func (vm *firecrackerVMManager) DestroyVM(ctx context.Context, vmInfo *VMInfo) e
 func (vm *firecrackerVMManager) GetVMStatus(ctx context.Context, vmInfo *VMInfo) (*VMStatus, error) {
 	logger := vm.logger.With("task_id", vmInfo.TaskID, "vm_id", vmInfo.VMID)
 	
-	if vmInfo.Machine == nil {
-		logger.Warn("machine is nil, returning unknown status")
-		return &VMStatus{State: VMStateUnknown}, nil
-	}
-	
-	// Check if the process is still running
-	pid, err := vmInfo.Machine.PID()
-	if err != nil || pid == 0 {
-		return &VMStatus{
+	// Check the recorded PID rather than asking the SDK, which only knows
+	// about processes started by this plugin instance. A VM recovered after
+	// it exited has no machine but still left its exit status.
+	if !vmmAlive(vmInfo) {
+		status := &VMStatus{
 			State: VMStateStopped,
 			PID:   vmInfo.PID,
-		}, nil
+		}
+
+		exit, err := readExitStatus(filepath.Join(vmInfo.VMDir, statusDriveName))
+		switch {
+		case err != nil:
+			status.Error = err
+		case exit == nil:
+			// The VM went away before the workload finished, e.g. because
+			// it was stopped or the guest crashed
+			status.Error = fmt.Errorf("VM exited without reporting the workload's exit status")
+		default:
+			code := uint32(exit.ExitCode)
+			status.ExitCode = &code
+			status.Signal = exit.Signal
+			if exit.Error != "" {
+				// init could not start the workload
+				status.Error = fmt.Errorf("%s", exit.Error)
+			}
+			logger.Info("workload exited", "exit_code", exit.ExitCode, "signal", exit.Signal)
+		}
+		return status, nil
 	}
-	
-	// Try to check if process exists
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return &VMStatus{
-			State: VMStateStopped,
-			PID:   vmInfo.PID,
-		}, nil
+
+	if vmInfo.Machine == nil {
+		logger.Warn("machine is nil, returning unknown status")
+		return &VMStatus{State: VMStateUnknown}, nil
 	}
 	
-	// Try to signal the process to check if it's alive (signal 0 means "check if alive")
-	if err := process.Signal(syscall.Signal(0)); err != nil {
-		return &VMStatus{
-			State: VMStateStopped,
-			PID:   vmInfo.PID,
-		}, nil
+	state := VMStateRunning
+	if vmPaused(ctx, vmInfo) {
+		state = VMStatePaused
 	}
-	
 	return &VMStatus{
-		State: VMStateRunning,
+		State: state,
 		PID:   vmInfo.PID,
 	}, nil
 }
 
-// Helper function to add agent to rootfs during VM creation
-func (vm *firecrackerVMManager) addVMAgentToRootfs(mountDir string) error {
-	vm.logger.Info("adding VM agent to rootfs", "mount_dir", mountDir)
-
-	// Create init.d directory
-	initDir := filepath.Join(mountDir, "etc", "init.d")
-	if err := os.MkdirAll(initDir, 0755); err != nil {
-		return fmt.Errorf("failed to create init.d directory: %w", err)
-	}
-
-	// Create VM agent script
-	vmAgentScriptPath := filepath.Join(initDir, "vm-agent")
-	vmAgentContent := `#!/bin/sh
-# VM Agent for command execution
-echo "VM Agent starting..."
-
-# Simple netcat-based agent for exec
-while true; do
-    nc -l -p 1024 -e /bin/sh 2>/dev/null || {
-        # Fallback for systems without netcat's -e
-        (echo "VM Agent Ready"; while read line; do eval "$line" 2>&1; done) | nc -l -p 1024
-    }
-done
-`
-	if err := os.WriteFile(vmAgentScriptPath, []byte(vmAgentContent), 0755); err != nil {
-		return fmt.Errorf("failed to write vm-agent script: %w", err)
-	}
-
-	// Create symlink for auto-start
-	rcDir := filepath.Join(mountDir, "etc", "rc5.d")
-	if err := os.MkdirAll(rcDir, 0755); err != nil {
-		return fmt.Errorf("failed to create rc.d directory: %w", err)
-	}
-	symlinkPath := filepath.Join(rcDir, "S99vm-agent")
-	if err := os.Symlink("../../init.d/vm-agent", symlinkPath); err != nil {
-		// Don't fail if symlink exists
-		if !os.IsExist(err) {
-			return fmt.Errorf("failed to create vm-agent symlink: %w", err)
+func (vm *firecrackerVMManager) PauseVM(ctx context.Context, vmInfo *VMInfo) error {
+	if vmInfo.Machine == nil || !vmmAlive(vmInfo) {
+		return fmt.Errorf("VM is not running")
+	}
+	if err := vmInfo.Machine.PauseVM(ctx); err != nil {
+		return fmt.Errorf("failed to pause VM: %w", err)
+	}
+	vm.logger.Info("VM paused", "task_id", vmInfo.TaskID, "vm_id", vmInfo.VMID)
+	return nil
+}
+
+func (vm *firecrackerVMManager) ResumeVM(ctx context.Context, vmInfo *VMInfo) error {
+	if vmInfo.Machine == nil || !vmmAlive(vmInfo) {
+		return fmt.Errorf("VM is not running")
+	}
+	if err := vmInfo.Machine.ResumeVM(ctx); err != nil {
+		return fmt.Errorf("failed to resume VM: %w", err)
+	}
+	vm.logger.Info("VM resumed", "task_id", vmInfo.TaskID, "vm_id", vmInfo.VMID)
+	return nil
+}
+
+// vmPaused asks firecracker whether a VM is paused. The state is not kept
+// by the driver, so VMs paused before a plugin restart are reported too.
+func vmPaused(ctx context.Context, vmInfo *VMInfo) bool {
+	if vmInfo.Machine == nil {
+		return false
+	}
+	info, err := vmInfo.Machine.DescribeInstanceInfo(ctx)
+	return err == nil && firecracker.StringValue(info.State) == models.InstanceInfoStatePaused
+}
+
+// createStatusDrive creates the zeroed file backing a VM's status drive
+func createStatusDrive(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create status drive: %w", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(statusDriveSize); err != nil {
+		return fmt.Errorf("failed to size status drive: %w", err)
+	}
+	return nil
+}
+
+// readExitStatus parses the exit status the guest init wrote to a status drive. It
+// returns nil if nothing was reported.
+func readExitStatus(path string) (*vminit.ExitStatus, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status drive: %w", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	line = strings.TrimRight(line, "\x00")
+	if line == "" {
+		return nil, nil
+	}
+
+	var status vminit.ExitStatus
+	if err := json.Unmarshal([]byte(line), &status); err != nil {
+		return nil, fmt.Errorf("failed to parse exit status %q: %w", line, err)
+	}
+	return &status, nil
+}
+
+// RecoverVM reconnects to a firecracker process started by a previous
+// instance of the plugin through its API socket
+func (vm *firecrackerVMManager) RecoverVM(ctx context.Context, vmInfo *VMInfo) error {
+	logger := vm.logger.With("task_id", vmInfo.TaskID, "vm_id", vmInfo.VMID, "pid", vmInfo.PID)
+
+	if vmInfo.SocketPath == "" || vmInfo.PID == 0 {
+		return fmt.Errorf("task state does not describe a VM")
+	}
+	if vmInfo.JailID != "" {
+		vm.jailUIDs.reserve(vmInfo.JailUID, vmInfo.TaskID)
+	}
+	if !vmmAlive(vmInfo) {
+		// The VM exited while the plugin was not running. The handle
+		// reports the exit status the guest left on its status drive, and
+		// the VM is cleaned up when Nomad destroys the task.
+		logger.Info("VM exited while the plugin was not running")
+		return nil
+	}
+
+	fcConfig := firecracker.Config{
+		SocketPath: vmInfo.SocketPath,
+		VMID:       vmInfo.VMID,
+	}
+	machine, err := firecracker.NewMachine(ctx, fcConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create firecracker machine: %w", err)
+	}
+
+	// The process was already matched to the VM, so an API that does not
+	// answer yet is no reason to give up on a running VM
+	var info models.InstanceInfo
+	for attempt := 0; attempt < recoverAPIAttempts; attempt++ {
+		if info, err = machine.DescribeInstanceInfo(ctx); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		logger.Warn("failed to reach firecracker API", "error", err)
+	}
+
+	vmInfo.Machine = machine
+	vmInfo.ExecClient = NewVMExecClient(vmInfo, vm.logger)
+
+	// Changes made while the plugin was not running are only copied once
+	// the files change again
+	vmInfo.taskDirSync = newTaskDirSyncer(vmInfo.TaskDirs, scanTaskDirs(vmInfo.TaskDirs), vmInfo.ExecClient, vm.logger)
+
+	// The locks on the VM's volumes went away with the previous plugin
+	for i := range vmInfo.VolumeLocks {
+		if err := vmInfo.VolumeLocks[i].lock(); err != nil {
+			logger.Warn("failed to lock volume", "error", err)
 		}
 	}
 
-	vm.logger.Info("VM agent added to rootfs")
+	logger.Info("reattached to VM", "state", firecracker.StringValue(info.State))
 	return nil
 }
+
+// vmmAlive reports whether the firecracker process of a VM is still running.
+// The command line is checked for the VM's API socket, or its jail ID for
+// jailed VMMs, so that a reused PID is not mistaken for the VM.
+func vmmAlive(vmInfo *VMInfo) bool {
+	if vmInfo.PID == 0 {
+		return false
+	}
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(int(vmInfo.PID)), "cmdline"))
+	if err != nil {
+		return false
+	}
+	want := vmInfo.SocketPath
+	if vmInfo.JailID != "" {
+		want = vmInfo.JailID
+	}
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if arg == want {
+			return true
+		}
+	}
+	return false
+}
+
+// stopVMM sends SIGTERM to the firecracker process of a VM. The SDK can only
+// signal processes this plugin instance started, so recovered VMs are
+// signalled by PID.
+func stopVMM(vmInfo *VMInfo) error {
+	if vmInfo.Machine != nil {
+		if _, err := vmInfo.Machine.PID(); err == nil {
+			return vmInfo.Machine.StopVMM()
+		}
+	}
+	if !vmmAlive(vmInfo) {
+		return nil
+	}
+	return syscall.Kill(int(vmInfo.PID), syscall.SIGTERM)
+}
+
+// vmAgentFiles returns the files that install the VM agent in a rootfs.
+// The guest init starts it before the workload.
+func (vm *firecrackerVMManager) vmAgentFiles() ([]guestFile, error) {
+	agentBinary, err := guestBinary("litegix-agent")
+	if err != nil {
+		return nil, err
+	}
+
+	vm.logger.Info("adding VM agent to rootfs", "path", guestAgentPath)
+	return []guestFile{
+		{Path: guestAgentPath, Mode: 0755, Data: agentBinary},
+	}, nil
+}
@@ -0,0 +1,180 @@
+package litegix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// writeStatusDrive creates a status drive in dir holding contents at its
+// start, as the guest init writes it to the block device
+func writeStatusDrive(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, statusDriveName)
+	if err := createStatusDrive(path); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte(contents), 0); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadExitStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		wantNil  bool
+		wantErr  string
+		exitCode int
+		signal   int
+		error    string
+	}{
+		{
+			name:    "blank drive",
+			wantNil: true,
+		},
+		{
+			name:     "exit code",
+			contents: `{"exit_code":3,"signal":0}` + "\n",
+			exitCode: 3,
+		},
+		{
+			name:     "killed by a signal",
+			contents: `{"exit_code":137,"signal":9}` + "\n",
+			exitCode: 137,
+			signal:   9,
+		},
+		{
+			name:     "workload failed to start",
+			contents: `{"exit_code":127,"signal":0,"error":"exec: not found"}` + "\n",
+			exitCode: 127,
+			error:    "exec: not found",
+		},
+		{
+			name:     "only the first line counts",
+			contents: `{"exit_code":0,"signal":0}` + "\n" + `{"exit_code":1}` + "\n",
+		},
+		{
+			name:     "partially written",
+			contents: `{"exit_code":1,"sig`,
+			wantErr:  "failed to parse exit status",
+		},
+		{
+			name:     "garbage",
+			contents: "\xff\xfe\n",
+			wantErr:  "failed to parse exit status",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeStatusDrive(t, t.TempDir(), tc.contents)
+			status, err := readExitStatus(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readExitStatus: %v", err)
+			}
+			if tc.wantNil {
+				if status != nil {
+					t.Fatalf("got %+v, want no status", *status)
+				}
+				return
+			}
+			if status == nil {
+				t.Fatal("got no status")
+			}
+			if status.ExitCode != tc.exitCode || status.Signal != tc.signal || status.Error != tc.error {
+				t.Errorf("got %+v, want exit code %d, signal %d, error %q", *status, tc.exitCode, tc.signal, tc.error)
+			}
+		})
+	}
+
+	if _, err := readExitStatus(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readExitStatus of a missing drive succeeded")
+	}
+}
+
+func TestGetVMStatus_Exited(t *testing.T) {
+	vm := &firecrackerVMManager{logger: hclog.NewNullLogger()}
+
+	cases := []struct {
+		name     string
+		contents string
+		exitCode *uint32
+		signal   int
+		wantErr  string
+	}{
+		{
+			name:     "workload exited",
+			contents: `{"exit_code":2,"signal":0}` + "\n",
+			exitCode: func() *uint32 { c := uint32(2); return &c }(),
+		},
+		{
+			name:     "workload killed",
+			contents: `{"exit_code":143,"signal":15}` + "\n",
+			exitCode: func() *uint32 { c := uint32(143); return &c }(),
+			signal:   15,
+		},
+		{
+			name:     "workload failed to start",
+			contents: `{"exit_code":127,"signal":0,"error":"no such file"}` + "\n",
+			exitCode: func() *uint32 { c := uint32(127); return &c }(),
+			wantErr:  "no such file",
+		},
+		{
+			name:    "VM went away without a status",
+			wantErr: "without reporting",
+		},
+		{
+			name:     "partially written status",
+			contents: `{"exit_`,
+			wantErr:  "failed to parse exit status",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeStatusDrive(t, dir, tc.contents)
+
+			// No PID, so the VMM is not running
+			status, err := vm.GetVMStatus(context.Background(), &VMInfo{VMDir: dir})
+			if err != nil {
+				t.Fatalf("GetVMStatus: %v", err)
+			}
+			if status.State != VMStateStopped {
+				t.Errorf("state = %s, want %s", status.State, VMStateStopped)
+			}
+			switch {
+			case tc.exitCode == nil && status.ExitCode != nil:
+				t.Errorf("exit code = %d, want none", *status.ExitCode)
+			case tc.exitCode != nil && (status.ExitCode == nil || *status.ExitCode != *tc.exitCode):
+				t.Errorf("exit code = %v, want %d", status.ExitCode, *tc.exitCode)
+			}
+			if status.Signal != tc.signal {
+				t.Errorf("signal = %d, want %d", status.Signal, tc.signal)
+			}
+			if tc.wantErr == "" && status.Error != nil {
+				t.Errorf("error = %v, want none", status.Error)
+			}
+			if tc.wantErr != "" && (status.Error == nil || !strings.Contains(status.Error.Error(), tc.wantErr)) {
+				t.Errorf("error = %v, want %q", status.Error, tc.wantErr)
+			}
+		})
+	}
+}
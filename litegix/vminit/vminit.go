@@ -0,0 +1,483 @@
+// Package vminit implements the PID 1 the driver boots every task VM with.
+// It prepares the guest, starts the exec agent, runs the workload, reaps
+// orphaned processes and reports the workload's exit status to the host
+// before shutting the VM down.
+package vminit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ConfigPath is where the driver places the init config in a rootfs
+	ConfigPath = "/.litegix/config.json"
+
+	// WorkloadPIDPath is where init records the workload's PID, so the
+	// exec agent can pass signals from the host on to it
+	WorkloadPIDPath = "/.litegix/workload.pid"
+
+	// killTimeout is how long remaining processes get to exit on SIGTERM
+	// before the VM shuts down
+	killTimeout = 2 * time.Second
+
+	// fallbackPath is searched for the workload when its env has no PATH
+	fallbackPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// statusDevice is where the exit status is reported. It defaults to the
+// device the driver attaches so that a broken config can still be reported.
+var statusDevice = "/dev/vdb"
+
+// Config describes the workload and guest setup. It is written by the
+// driver as JSON to ConfigPath.
+type Config struct {
+	// Args is the workload's argv
+	Args []string `json:"args"`
+
+	// Env holds the workload's environment as KEY=VALUE pairs
+	Env []string `json:"env"`
+
+	WorkingDir string `json:"working_dir,omitempty"`
+	UID        uint32 `json:"uid"`
+	GID        uint32 `json:"gid"`
+	Hostname   string `json:"hostname,omitempty"`
+
+	// AgentPath is the exec agent binary started before the workload, and
+	// AgentLogPath the file its output goes to
+	AgentPath    string `json:"agent_path,omitempty"`
+	AgentLogPath string `json:"agent_log_path,omitempty"`
+
+	// StatusDevice is the block device the exit status is written to
+	StatusDevice string `json:"status_device"`
+
+	// Mounts are the block devices mounted before the workload starts, and
+	// DeviceLinks the ones made available under another path
+	Mounts      []Mount      `json:"mounts,omitempty"`
+	DeviceLinks []DeviceLink `json:"device_links,omitempty"`
+}
+
+// Mount is a filesystem on a block device attached by the driver. An empty
+// FSType is detected from the filesystems the kernel supports.
+type Mount struct {
+	Device   string `json:"device"`
+	Path     string `json:"path"`
+	FSType   string `json:"fs_type"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// DeviceLink is a symlink at Path to a block device attached by the driver
+type DeviceLink struct {
+	Device string `json:"device"`
+	Path   string `json:"path"`
+}
+
+// ExitStatus is what init reports on the status device once the workload
+// has exited
+type ExitStatus struct {
+	ExitCode int    `json:"exit_code"`
+	Signal   int    `json:"signal"`
+	Error    string `json:"error,omitempty"`
+}
+
+// mount describes a pseudo filesystem mounted before the workload starts
+type mount struct {
+	source, target, fstype string
+	flags                  uintptr
+	data                   string
+}
+
+var mounts = []mount{
+	{"proc", "/proc", "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"devtmpfs", "/dev", "devtmpfs", unix.MS_NOSUID, "mode=0755"},
+	{"devpts", "/dev/pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, "gid=5,mode=0620,ptmxmode=0666"},
+	{"tmpfs", "/dev/shm", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=1777"},
+}
+
+// Run runs init. It never returns, as PID 1 exiting panics the kernel.
+func Run() {
+	status := run()
+
+	if err := reportStatus(status); err != nil {
+		logf("failed to report exit status: %v", err)
+	}
+	shutdown()
+}
+
+// run sets up the guest and runs the workload until it exits
+func run() *ExitStatus {
+	// Have the kernel deliver Ctrl+Alt+Del, which the host sends to stop
+	// the VM, to init as SIGINT instead of restarting right away
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_CAD_OFF); err != nil {
+		logf("failed to disable Ctrl+Alt+Del reboot: %v", err)
+	}
+
+	// Signals are forwarded to the workload once it runs, and SIGCHLD
+	// wakes the reaper. They are caught from the start so a stop request
+	// arriving during setup is not lost.
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+
+	for _, m := range mounts {
+		if err := mountFS(m); err != nil {
+			logf("failed to mount %s: %v", m.target, err)
+		}
+	}
+
+	// The kernel cannot open a console when the image has no /dev, so make
+	// sure output reaches the serial console now that devtmpfs is mounted
+	attachConsole()
+
+	config, err := ReadConfig()
+	if err != nil {
+		return &ExitStatus{ExitCode: 1, Error: err.Error()}
+	}
+	statusDevice = config.StatusDevice
+
+	for _, m := range config.Mounts {
+		if err := mountDevice(m); err != nil {
+			return &ExitStatus{ExitCode: 1, Error: fmt.Sprintf("failed to mount %s at %s: %v", m.Device, m.Path, err)}
+		}
+	}
+	for _, l := range config.DeviceLinks {
+		if err := linkDevice(l); err != nil {
+			return &ExitStatus{ExitCode: 1, Error: fmt.Sprintf("failed to link %s to %s: %v", l.Path, l.Device, err)}
+		}
+	}
+
+	if config.Hostname != "" {
+		if err := unix.Sethostname([]byte(config.Hostname)); err != nil {
+			logf("failed to set hostname: %v", err)
+		}
+	}
+
+	// The kernel configures eth0 from the ip= boot parameter, but leaves
+	// the loopback interface and name resolution to init
+	if err := setLinkUp("lo"); err != nil {
+		logf("failed to bring up loopback interface: %v", err)
+	}
+	if err := writeResolvConf(); err != nil {
+		logf("failed to write /etc/resolv.conf: %v", err)
+	}
+
+	if config.AgentPath != "" {
+		if err := startAgent(config); err != nil {
+			logf("failed to start exec agent: %v", err)
+		}
+	}
+
+	workload, err := startWorkload(config)
+	if err != nil {
+		return &ExitStatus{ExitCode: 127, Error: err.Error()}
+	}
+	if err := os.WriteFile(WorkloadPIDPath, []byte(strconv.Itoa(workload.Pid)), 0644); err != nil {
+		logf("failed to record workload PID: %v", err)
+	}
+
+	for {
+		// Reap every child that has exited, including orphans reparented
+		// to init
+		for {
+			var ws unix.WaitStatus
+			pid, err := unix.Wait4(-1, &ws, unix.WNOHANG, nil)
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid == workload.Pid {
+				return exitStatus(ws)
+			}
+		}
+
+		sig := <-sigs
+		switch sig {
+		case unix.SIGCHLD, unix.SIGURG:
+			// SIGURG is used internally by the Go runtime
+		case unix.SIGINT, unix.SIGTERM:
+			// The host requests shutdown through Ctrl+Alt+Del, which
+			// the kernel delivers to init as SIGINT since CAD is off
+			workload.Signal(unix.SIGTERM)
+		default:
+			workload.Signal(sig)
+		}
+	}
+}
+
+func mountFS(m mount) error {
+	if err := os.MkdirAll(m.target, 0755); err != nil {
+		return err
+	}
+	err := unix.Mount(m.source, m.target, m.fstype, m.flags, m.data)
+	if errors.Is(err, unix.EBUSY) {
+		// The kernel may have mounted devtmpfs already
+		return nil
+	}
+	return err
+}
+
+// mountDevice mounts a drive attached by the driver
+func mountDevice(m Mount) error {
+	if err := os.MkdirAll(m.Path, 0755); err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV)
+	if m.ReadOnly {
+		flags |= unix.MS_RDONLY
+	}
+	if m.FSType != "" {
+		return unix.Mount(m.Device, m.Path, m.FSType, flags, "")
+	}
+
+	err := fmt.Errorf("no supported filesystem found")
+	for _, fsType := range blockFilesystems() {
+		if err = unix.Mount(m.Device, m.Path, fsType, flags, ""); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// blockFilesystems returns the filesystems the kernel supports that live on
+// block devices
+func blockFilesystems() []string {
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return nil
+	}
+	var types []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			types = append(types, fields[0])
+		}
+	}
+	return types
+}
+
+// linkDevice makes a block device available at another path
+func linkDevice(l DeviceLink) error {
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+		return err
+	}
+	os.Remove(l.Path)
+	return os.Symlink(l.Device, l.Path)
+}
+
+func attachConsole() {
+	console, err := os.OpenFile("/dev/console", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer console.Close()
+	for fd := 0; fd <= 2; fd++ {
+		unix.Dup3(int(console.Fd()), fd, 0)
+	}
+}
+
+// setLinkUp brings up the network interface called name
+func setLinkUp(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// writeResolvConf points the guest at the nameservers passed in the ip=
+// boot parameter, which the kernel lists in resolv.conf format
+func writeResolvConf() error {
+	pnp, err := os.ReadFile("/proc/net/pnp")
+	if err != nil {
+		// The kernel did not configure the network
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(pnp), "\n") {
+		if strings.HasPrefix(line, "nameserver ") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll("/etc", 0755); err != nil {
+		return err
+	}
+	return os.WriteFile("/etc/resolv.conf", []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// ReadConfig reads the init config the driver placed at ConfigPath
+func ReadConfig() (*Config, error) {
+	data, err := os.ReadFile(ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read init config: %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse init config: %w", err)
+	}
+	if len(config.Args) == 0 {
+		return nil, fmt.Errorf("init config has no command")
+	}
+	return &config, nil
+}
+
+// startAgent starts the exec agent as root with the workload's environment
+func startAgent(config *Config) error {
+	logFile, err := os.OpenFile(config.AgentLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logFile, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	defer logFile.Close()
+
+	_, err = os.StartProcess(config.AgentPath, []string{config.AgentPath}, &os.ProcAttr{
+		Dir:   "/",
+		Env:   config.Env,
+		Files: []*os.File{nil, logFile, logFile},
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	return err
+}
+
+// startWorkload starts the workload in its own session with its stdin on
+// /dev/null and its output on the console
+func startWorkload(config *Config) (*os.Process, error) {
+	dir := "/"
+	if config.WorkingDir != "" {
+		if err := os.MkdirAll(config.WorkingDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create working directory: %w", err)
+		}
+		dir = config.WorkingDir
+	}
+
+	path, err := lookPath(config.Args[0], config.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	defer stdin.Close()
+
+	sys := &syscall.SysProcAttr{Setsid: true}
+	if config.UID != 0 || config.GID != 0 {
+		sys.Credential = &syscall.Credential{
+			Uid:    config.UID,
+			Gid:    config.GID,
+			Groups: []uint32{},
+		}
+	}
+
+	process, err := os.StartProcess(path, config.Args, &os.ProcAttr{
+		Dir:   dir,
+		Env:   config.Env,
+		Files: []*os.File{stdin, os.Stdout, os.Stderr},
+		Sys:   sys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", config.Args[0], err)
+	}
+	return process, nil
+}
+
+// lookPath resolves file against the PATH in env, the way exec.LookPath
+// does against the current environment
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+
+	path := fallbackPath
+	for _, e := range env {
+		if value, ok := strings.CutPrefix(e, "PATH="); ok {
+			path = value
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, file)
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("executable file %q not found in $PATH", file)
+}
+
+// exitStatus converts a wait status into the reported ExitStatus
+func exitStatus(ws unix.WaitStatus) *ExitStatus {
+	if ws.Signaled() {
+		sig := int(ws.Signal())
+		return &ExitStatus{ExitCode: 128 + sig, Signal: sig}
+	}
+	return &ExitStatus{ExitCode: ws.ExitStatus()}
+}
+
+// reportStatus writes the exit status to the status device
+func reportStatus(status *ExitStatus) error {
+	logf("workload exited with code %d", status.ExitCode)
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(statusDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// shutdown stops all remaining processes and reboots, which makes
+// firecracker exit
+func shutdown() {
+	unix.Kill(-1, unix.SIGTERM)
+	deadline := time.Now().Add(killTimeout)
+	for time.Now().Before(deadline) {
+		var ws unix.WaitStatus
+		if _, err := unix.Wait4(-1, &ws, unix.WNOHANG, nil); errors.Is(err, unix.ECHILD) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	unix.Kill(-1, unix.SIGKILL)
+
+	unix.Sync()
+	for {
+		if err := unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART); err != nil {
+			logf("failed to reboot: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "litegix-init: "+format+"\n", args...)
+}
@@ -0,0 +1,265 @@
+package litegix
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shadm/nomad-litegix-fc-driver/litegix/vminit"
+	"golang.org/x/sys/unix"
+)
+
+// volumeImageName is the image that backs a directory volume. It is kept in
+// the directory itself, so its data outlives the allocation.
+const volumeImageName = ".litegix-volume.ext4"
+
+// volume is host storage attached to the guest as a drive of its own
+type volume struct {
+	// Source is a block device, a filesystem image or a directory
+	Source string
+
+	// Dest is where the guest mounts the volume, or for devices the path
+	// linked to its block device
+	Dest string
+
+	ReadOnly bool
+	Device   bool
+}
+
+// taskVolumes collects the volumes of a task: Nomad's volume_mount blocks
+// for host and CSI volumes, devices, and the volumes task option
+func taskVolumes(cfg *drivers.TaskConfig, config *TaskConfig, driverConfig *Config) ([]volume, error) {
+	var volumes []volume
+	for _, m := range cfg.Mounts {
+		volumes = append(volumes, volume{
+			Source:   m.HostPath,
+			Dest:     m.TaskPath,
+			ReadOnly: m.Readonly,
+		})
+	}
+	for _, d := range cfg.Devices {
+		volumes = append(volumes, volume{
+			Source:   d.HostPath,
+			Dest:     d.TaskPath,
+			ReadOnly: !strings.Contains(d.Permissions, "w"),
+			Device:   true,
+		})
+	}
+
+	for _, spec := range config.Volumes {
+		v, err := parseVolume(spec, cfg.TaskDir().Dir, driverConfig.VolumesEnabled)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, *v)
+	}
+
+	for i := range volumes {
+		if !filepath.IsAbs(volumes[i].Dest) {
+			volumes[i].Dest = "/" + volumes[i].Dest
+		}
+	}
+	return volumes, nil
+}
+
+// parseVolume parses a volumes entry of the form source:destination[:ro].
+// Relative sources are inside the task directory; others need
+// volumes_enabled.
+func parseVolume(spec, taskDir string, enabled bool) (*volume, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid volume %q, must be source:destination[:ro]", spec)
+	}
+	v := &volume{Source: parts[0], Dest: parts[1]}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			v.ReadOnly = true
+		case "rw":
+		default:
+			return nil, fmt.Errorf("invalid volume %q, mode must be ro or rw", spec)
+		}
+	}
+
+	if filepath.IsAbs(v.Source) {
+		if !enabled {
+			return nil, fmt.Errorf("volume %q uses a host path, but volumes_enabled is not set", spec)
+		}
+		return v, nil
+	}
+	v.Source = filepath.Join(taskDir, v.Source)
+	if rel, err := filepath.Rel(taskDir, v.Source); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("volume %q is outside the task directory", spec)
+	}
+	return v, nil
+}
+
+// volumeDrives returns the drives backing the task's volumes, attached
+// starting at device index first, along with the mounts and device links
+// the guest init makes for them.
+//
+// Block devices and image files are attached as they are. A read-write
+// directory is backed by an image kept inside it, created on first use
+// only if the directory is empty, as the guest could not see files already
+// in it. A read-only directory without such an image is copied into one in
+// vmDir, so the guest sees its current contents.
+func (vm *firecrackerVMManager) volumeDrives(ctx context.Context, vmDir string, volumes []volume, first int) ([]models.Drive, []vminit.Mount, []vminit.DeviceLink, error) {
+	var drives []models.Drive
+	var mounts []vminit.Mount
+	var links []vminit.DeviceLink
+	for i, v := range volumes {
+		fi, err := os.Stat(v.Source)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to find volume source: %w", err)
+		}
+
+		path := v.Source
+		fsType := ""
+		switch {
+		case v.Device && fi.Mode()&os.ModeCharDevice != 0:
+			// Character devices such as GPUs cannot be passed to a VM
+			vm.logger.Warn("skipping device, only block devices can be attached to VMs", "device", v.Source)
+			continue
+		case fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0:
+		case fi.Mode().IsRegular():
+		case fi.IsDir() && !v.Device:
+			path = filepath.Join(v.Source, volumeImageName)
+			fsType = "ext4"
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				if v.ReadOnly {
+					path = filepath.Join(vmDir, fmt.Sprintf("volume%d.ext4", i))
+					if _, err := buildExt4(ctx, v.Source, path, nil); err != nil {
+						return nil, nil, nil, fmt.Errorf("failed to copy volume %s: %w", v.Source, err)
+					}
+				} else if err := createVolumeImage(ctx, v.Source, path, vm.config.VolumeImageSize); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+		default:
+			return nil, nil, nil, fmt.Errorf("volume source %s is not a block device, image file or directory", v.Source)
+		}
+
+		device := driveDevice(first + len(drives))
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String(fmt.Sprintf("volume%d", i)),
+			PathOnHost:   firecracker.String(path),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(v.ReadOnly),
+		})
+		if v.Device {
+			links = append(links, vminit.DeviceLink{Device: device, Path: v.Dest})
+		} else {
+			mounts = append(mounts, vminit.Mount{Device: device, Path: v.Dest, FSType: fsType, ReadOnly: v.ReadOnly})
+		}
+	}
+	return drives, mounts, links, nil
+}
+
+// volumeLock is the lock a VM holds on a volume image or device,
+// exclusive for read-write volumes and shared for read-only ones, so no
+// other VM attaches it read-write while the VM runs
+type volumeLock struct {
+	Path     string
+	ReadOnly bool
+
+	file *os.File
+}
+
+// createVolumeImage creates the image backing the read-write directory
+// volume dir at path. Files in the directory would be hidden from the guest
+// and the guest's writes from the host, so only empty directories get one.
+func createVolumeImage(ctx context.Context, dir, path string, sizeMB int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read volume %s: %w", dir, err)
+	}
+	if len(entries) != 0 {
+		return fmt.Errorf("read-write volume %s is a directory with files but no %s image: "+
+			"VMs cannot share a directory's files read-write, so mount it read-only, or use an empty directory, an image file or a block device",
+			dir, volumeImageName)
+	}
+	if err := createExt4(ctx, path, sizeMB); err != nil {
+		return fmt.Errorf("failed to create volume image in %s: %w", dir, err)
+	}
+	return nil
+}
+
+// lockVolumes locks the images and devices of a VM's volumes. Drives in
+// vmDir belong to the task alone.
+func lockVolumes(drives []models.Drive, vmDir string) ([]volumeLock, error) {
+	var locks []volumeLock
+	for _, drive := range drives {
+		l := volumeLock{
+			Path:     firecracker.StringValue(drive.PathOnHost),
+			ReadOnly: firecracker.BoolValue(drive.IsReadOnly),
+		}
+		if filepath.Dir(l.Path) == vmDir {
+			continue
+		}
+		if err := l.lock(); err != nil {
+			unlockVolumes(locks)
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, nil
+}
+
+func (l *volumeLock) lock() error {
+	f, err := os.Open(l.Path)
+	if err != nil {
+		return fmt.Errorf("failed to lock volume %s: %w", l.Path, err)
+	}
+	how := unix.LOCK_EX
+	if l.ReadOnly {
+		how = unix.LOCK_SH
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return fmt.Errorf("volume %s is in use by another VM that writes to it, or this task writes to it while another VM uses it", l.Path)
+		}
+		return fmt.Errorf("failed to lock volume %s: %w", l.Path, err)
+	}
+	l.file = f
+	return nil
+}
+
+// unlockVolumes releases the locks of a VM's volumes
+func unlockVolumes(locks []volumeLock) {
+	for i := range locks {
+		if locks[i].file != nil {
+			locks[i].file.Close()
+			locks[i].file = nil
+		}
+	}
+}
+
+// createExt4 creates an empty, sparse ext4 image of sizeMB
+func createExt4(ctx context.Context, imagePath string, sizeMB int) error {
+	f, err := os.OpenFile(imagePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(sizeMB) * 1024 * 1024)
+	f.Close()
+	if err != nil {
+		os.Remove(imagePath)
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "mkfs.ext4", "-F", "-q", "-t", "ext4", "-E", "root_owner=0:0", imagePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(imagePath)
+		return fmt.Errorf("failed to format image: %w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}